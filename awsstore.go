@@ -0,0 +1,419 @@
+/*
+ * awsstore.go
+ * ObjectStore on Amazon S3 and S3-compatible servers
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
+)
+
+
+// AWSStore is the ObjectStore of one bucket, through the AWS SDK. Retries
+// and signing are set up on the client, see NewClient; each call gets
+// request_timeout per attempt and total_timeout overall.
+type AWSStore struct {
+
+	client  *aws_s3.S3
+	bucket  string
+	attempt time.Duration
+	total   time.Duration
+}
+
+
+func NewAWSStore(client *aws_s3.S3, bucket string, config S3Config) *AWSStore {
+
+	return &AWSStore{
+		client:  client,
+		bucket:  bucket,
+		attempt: requestTimeout(config),
+		total:   totalTimeout(config),
+	}
+}
+
+
+// context bounds one call, retries included, by total_timeout.
+func (self *AWSStore) context() (context.Context, context.CancelFunc) {
+
+	if self.total > 0 {
+		return context.WithTimeout(context.Background(), self.total)
+	}
+	return context.WithCancel(context.Background())
+}
+
+
+// options gives every attempt of a call request_timeout to make progress.
+func (self *AWSStore) options() []request.Option {
+
+	if self.attempt <= 0 {
+		return nil
+	}
+	return []request.Option{request.WithResponseReadTimeout(self.attempt), attemptTimeout(self.attempt)}
+}
+
+
+func (self *AWSStore) List(prefix string, delimiter string, token string, max int) (ListPage, error) {
+
+	input := &aws_s3.ListObjectsV2Input{
+		Bucket: aws.String(self.bucket),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+	if token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+	if max > 0 {
+		input.MaxKeys = aws.Int64(int64(max))
+	}
+
+	page := ListPage{}
+	ctx, cancel := self.context()
+	defer cancel()
+	resp, err := self.client.ListObjectsV2WithContext(ctx, input, self.options()...)
+	if err != nil {
+		return page, err
+	}
+
+	for _, item := range resp.CommonPrefixes {
+		page.Prefixes = append(page.Prefixes, aws.StringValue(item.Prefix))
+	}
+	for _, item := range resp.Contents {
+		page.Objects = append(page.Objects, ObjectInfo{
+			Key:          aws.StringValue(item.Key),
+			Size:         aws.Int64Value(item.Size),
+			ETag:         strings.Trim(aws.StringValue(item.ETag), `"`),
+			LastModified: aws.TimeValue(item.LastModified),
+		})
+	}
+	if aws.BoolValue(resp.IsTruncated) {
+		page.Next = aws.StringValue(resp.NextContinuationToken)
+	}
+	return page, nil
+}
+
+
+func (self *AWSStore) Head(key string) (ObjectInfo, error) {
+
+	ctx, cancel := self.context()
+	defer cancel()
+	head, err := self.client.HeadObjectWithContext(ctx, &aws_s3.HeadObjectInput{
+		Bucket: aws.String(self.bucket),
+		Key:    aws.String(key),
+	}, self.options()...)
+	if err != nil {
+		return ObjectInfo{Key: key}, err
+	}
+
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(head.ContentLength),
+		ETag:         strings.Trim(aws.StringValue(head.ETag), `"`),
+		LastModified: aws.TimeValue(head.LastModified),
+		Metadata:     head.Metadata,
+		ContentHeaders: ContentHeaders{
+			ContentType:        aws.StringValue(head.ContentType),
+			CacheControl:       aws.StringValue(head.CacheControl),
+			ContentDisposition: aws.StringValue(head.ContentDisposition),
+			ContentEncoding:    aws.StringValue(head.ContentEncoding),
+			ContentLanguage:    aws.StringValue(head.ContentLanguage),
+		},
+	}, nil
+}
+
+
+func (self *AWSStore) GetRange(key string, off int64, n int64) (io.ReadCloser, error) {
+
+	rng := fmt.Sprintf("bytes=%d-", off)
+	if n >= 0 {
+		rng = fmt.Sprintf("bytes=%d-%d", off, off+n-1)
+	}
+
+	// the body is read after the call returns: total_timeout runs until it
+	// is closed, and each attempt only gets the read timeout
+	ctx, cancel := self.context()
+	var opts []request.Option
+	if self.attempt > 0 {
+		opts = append(opts, request.WithResponseReadTimeout(self.attempt))
+	}
+	output, err := self.client.GetObjectWithContext(ctx, &aws_s3.GetObjectInput{
+		Bucket: aws.String(self.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(rng),
+	}, opts...)
+	if err != nil {
+		cancel()
+		// the range starts at or past the end of the object
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 416 {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return &cancelBody{ReadCloser: output.Body, cancel: cancel}, nil
+}
+
+
+// cancelBody ends the context of a GetObject when its body is closed.
+type cancelBody struct {
+
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+
+func (self *cancelBody) Close() error {
+
+	err := self.ReadCloser.Close()
+	self.cancel()
+	return err
+}
+
+
+func (self *AWSStore) Put(key string, body io.ReadSeeker, opts PutOptions) (ObjectInfo, error) {
+
+	input := &aws_s3.PutObjectInput{
+		Bucket:             aws.String(self.bucket),
+		Key:                aws.String(key),
+		Body:               body,
+		ACL:                aws.String("private"),
+		Metadata:           opts.Metadata,
+		ContentType:        optString(opts.ContentType),
+		CacheControl:       optString(opts.CacheControl),
+		ContentDisposition: optString(opts.ContentDisposition),
+		ContentEncoding:    optString(opts.ContentEncoding),
+		ContentLanguage:    optString(opts.ContentLanguage),
+	}
+
+	ctx, cancel := self.context()
+	defer cancel()
+	req, out := self.client.PutObjectRequest(input)
+	req.SetContext(ctx)
+	req.ApplyOptions(self.options()...)
+	if opts.IfNoneMatch {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+	err := req.Send()
+	if err != nil {
+		return ObjectInfo{Key: key}, err
+	}
+	return ObjectInfo{
+		Key:          key,
+		ETag:         strings.Trim(aws.StringValue(out.ETag), `"`),
+		LastModified: time.Now(),
+	}, nil
+}
+
+
+func (self *AWSStore) Copy(src string, dst string, opts *PutOptions) (ObjectInfo, error) {
+
+	input := &aws_s3.CopyObjectInput{
+		Bucket:     aws.String(self.bucket),
+		Key:        aws.String(dst),
+		CopySource: aws.String(copySource(self.bucket, src)),
+		ACL:        aws.String("private"),
+	}
+	if opts != nil {
+		input.MetadataDirective = aws.String(aws_s3.MetadataDirectiveReplace)
+		input.Metadata = opts.Metadata
+		input.ContentType = optString(opts.ContentType)
+		input.CacheControl = optString(opts.CacheControl)
+		input.ContentDisposition = optString(opts.ContentDisposition)
+		input.ContentEncoding = optString(opts.ContentEncoding)
+		input.ContentLanguage = optString(opts.ContentLanguage)
+	}
+
+	ctx, cancel := self.context()
+	defer cancel()
+	out, err := self.client.CopyObjectWithContext(ctx, input, self.options()...)
+	if err != nil {
+		return ObjectInfo{Key: dst}, err
+	}
+
+	info := ObjectInfo{Key: dst, LastModified: time.Now()}
+	if result := out.CopyObjectResult; result != nil {
+		info.ETag = strings.Trim(aws.StringValue(result.ETag), `"`)
+		info.LastModified = aws.TimeValue(result.LastModified)
+	}
+	return info, nil
+}
+
+
+func (self *AWSStore) Delete(key string) error {
+
+	ctx, cancel := self.context()
+	defer cancel()
+	_, err := self.client.DeleteObjectWithContext(ctx, &aws_s3.DeleteObjectInput{
+		Bucket: aws.String(self.bucket),
+		Key:    aws.String(key),
+	}, self.options()...)
+	return err
+}
+
+
+// DeleteKeys reports the first key that failed, if any.
+func (self *AWSStore) DeleteKeys(keys []string) error {
+
+	objects := make([]*aws_s3.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objects[i] = &aws_s3.ObjectIdentifier{Key: aws.String(key)}
+	}
+
+	ctx, cancel := self.context()
+	defer cancel()
+	resp, err := self.client.DeleteObjectsWithContext(ctx, &aws_s3.DeleteObjectsInput{
+		Bucket: aws.String(self.bucket),
+		Delete: &aws_s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	}, self.options()...)
+	if err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		e := resp.Errors[0]
+		return awserr.New(aws.StringValue(e.Code), aws.StringValue(e.Key)+": "+aws.StringValue(e.Message), nil)
+	}
+	return nil
+}
+
+
+func (self *AWSStore) CreateMultipart(key string, opts PutOptions) (string, error) {
+
+	ctx, cancel := self.context()
+	defer cancel()
+	create, err := self.client.CreateMultipartUploadWithContext(ctx, &aws_s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(self.bucket),
+		Key:                aws.String(key),
+		ACL:                aws.String("private"),
+		Metadata:           opts.Metadata,
+		ContentType:        optString(opts.ContentType),
+		CacheControl:       optString(opts.CacheControl),
+		ContentDisposition: optString(opts.ContentDisposition),
+		ContentEncoding:    optString(opts.ContentEncoding),
+		ContentLanguage:    optString(opts.ContentLanguage),
+	}, self.options()...)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(create.UploadId), nil
+}
+
+
+func (self *AWSStore) UploadPart(key string, uploadId string, n int64, body io.ReadSeeker) (string, error) {
+
+	ctx, cancel := self.context()
+	defer cancel()
+	out, err := self.client.UploadPartWithContext(ctx, &aws_s3.UploadPartInput{
+		Bucket:     aws.String(self.bucket),
+		Key:        aws.String(key),
+		UploadId:   aws.String(uploadId),
+		PartNumber: aws.Int64(n),
+		Body:       body,
+	}, self.options()...)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+
+func (self *AWSStore) UploadPartCopy(key string, uploadId string, n int64, src string, off int64, end int64) (string, error) {
+
+	ctx, cancel := self.context()
+	defer cancel()
+	out, err := self.client.UploadPartCopyWithContext(ctx, &aws_s3.UploadPartCopyInput{
+		Bucket:          aws.String(self.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadId),
+		PartNumber:      aws.Int64(n),
+		CopySource:      aws.String(copySource(self.bucket, src)),
+		CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", off, end-1)),
+	}, self.options()...)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.CopyPartResult.ETag), nil
+}
+
+
+func (self *AWSStore) CompleteMultipart(key string, uploadId string, parts []Part) (ObjectInfo, error) {
+
+	completed := make([]*aws_s3.CompletedPart, len(parts))
+	for i, part := range parts {
+		completed[i] = &aws_s3.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int64(part.Number),
+		}
+	}
+
+	ctx, cancel := self.context()
+	defer cancel()
+	out, err := self.client.CompleteMultipartUploadWithContext(ctx, &aws_s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(self.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &aws_s3.CompletedMultipartUpload{Parts: completed},
+	}, self.options()...)
+	if err != nil {
+		return ObjectInfo{Key: key}, err
+	}
+	return ObjectInfo{
+		Key:          key,
+		ETag:         strings.Trim(aws.StringValue(out.ETag), `"`),
+		LastModified: time.Now(),
+	}, nil
+}
+
+
+func (self *AWSStore) AbortMultipart(key string, uploadId string) error {
+
+	ctx, cancel := self.context()
+	defer cancel()
+	_, err := self.client.AbortMultipartUploadWithContext(ctx, &aws_s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(self.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}, self.options()...)
+	return err
+}
+
+
+// optString leaves empty headers unset.
+func optString(s string) *string {
+
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+
+// copySource is the x-amz-copy-source header for key, URL-encoded.
+func copySource(bucket string, key string) string {
+
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		// "+" too, some servers read it as a space
+		parts[i] = strings.ReplaceAll(url.PathEscape(part), "+", "%2B")
+	}
+	return fmt.Sprintf("%s/%s", bucket, strings.Join(parts, "/"))
+}
@@ -0,0 +1,358 @@
+/*
+ * cache.go
+ * Metadata cache: attributes, directory listings and missing paths
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"container/list"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// Defaults for the *_cache_ttl and cache_size mount options.
+const (
+	defaultStatCacheTTL     = time.Minute
+	defaultDirCacheTTL      = 30 * time.Second
+	defaultNegativeCacheTTL = 5 * time.Second
+	defaultCacheSize        = 100000
+)
+
+
+// MetaCache remembers what S3 said about paths, so that repeated stat and
+// ls calls do not each cost a request. Three kinds of entries share one LRU
+// list and one size cap, counted in paths:
+//
+//   - nodes, the attributes of a path, kept for stat_cache_ttl
+//   - misses, paths found not to exist, kept for negative_cache_ttl
+//   - listings, complete directory listings, kept for dir_cache_ttl
+//
+// Nodes in use by an open writer or a background upload never expire or get
+// evicted; their local state is newer than anything in S3.
+type MetaCache struct {
+
+	statTTL     time.Duration
+	dirTTL      time.Duration
+	negativeTTL time.Duration
+	size        int
+
+	lock     sync.Mutex
+	nodes    map[string]*cacheEntry
+	listings map[string]*cacheEntry
+	lru      *list.List    // front is most recently used
+	used     int
+}
+
+
+type cacheEntry struct {
+
+	path    string
+	node    *Node            // nil for a miss
+	entries []S3FileObject   // listings only
+	listing bool
+	expires time.Time
+	elem    *list.Element
+}
+
+
+func NewMetaCache(config S3Config) *MetaCache {
+
+	cache := &MetaCache{
+		statTTL:     config.StatCacheTTL,
+		dirTTL:      config.DirCacheTTL,
+		negativeTTL: config.NegativeCacheTTL,
+		size:        config.CacheSize,
+		nodes:       make(map[string]*cacheEntry),
+		listings:    make(map[string]*cacheEntry),
+		lru:         list.New(),
+	}
+
+	if cache.statTTL == 0 {
+		cache.statTTL = defaultStatCacheTTL
+	}
+	if cache.dirTTL == 0 {
+		cache.dirTTL = defaultDirCacheTTL
+	}
+	if cache.negativeTTL == 0 {
+		cache.negativeTTL = defaultNegativeCacheTTL
+	}
+	if cache.size <= 0 {
+		cache.size = defaultCacheSize
+	}
+	return cache
+}
+
+
+// Get returns the cached node of fpath. hit is false when S3 has to be
+// asked; a hit with a nil node is a cached miss.
+func (self *MetaCache) Get(fpath string) (node *Node, hit bool) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	e, found := self.nodes[fpath]
+	if !found {
+		return nil, false
+	}
+	// expired nodes stay until Put refreshes them in place
+	if time.Now().After(e.expires) && (e.node == nil || !e.node.busy()) {
+		return nil, false
+	}
+	self.lru.MoveToFront(e.elem)
+	return e.node, true
+}
+
+
+// Put caches the node of fpath, or refreshes the cached one, which is
+// updated in place so that open handles see the change.
+func (self *MetaCache) Put(fpath string, info S3FileObject) *Node {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	e, found := self.nodes[fpath]
+	if !found || e.node == nil || e.node.IsDir != info.IsDir {
+		if found {
+			self.remove(e)
+		}
+		e = &cacheEntry{path: fpath, node: &Node{Path: fpath, IsDir: info.IsDir}}
+		self.add(self.nodes, e)
+	} else {
+		self.lru.MoveToFront(e.elem)
+	}
+	e.node.update(info)
+
+	// uncached nodes still work, they are just looked up again next time
+	e.expires = time.Now().Add(self.statTTL)
+	if self.statTTL < 0 {
+		e.expires = time.Time{}
+	}
+	self.evict()
+	return e.node
+}
+
+
+// Offer caches info for fpath unless the cache already has a live entry,
+// which is likely newer than a cached listing. It returns the node either
+// way.
+func (self *MetaCache) Offer(fpath string, info S3FileObject) *Node {
+
+	self.lock.Lock()
+	e, found := self.nodes[fpath]
+	live := found && e.node != nil && !time.Now().After(e.expires)
+	self.lock.Unlock()
+
+	if live {
+		return e.node
+	}
+	return self.Put(fpath, info)
+}
+
+
+// Miss remembers that fpath does not exist.
+func (self *MetaCache) Miss(fpath string) {
+
+	if self.negativeTTL < 0 {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if e, found := self.nodes[fpath]; found {
+		if e.node != nil && e.node.busy() {
+			return
+		}
+		self.remove(e)
+	}
+	e := &cacheEntry{path: fpath, expires: time.Now().Add(self.negativeTTL)}
+	self.add(self.nodes, e)
+	self.evict()
+}
+
+
+// Drop forgets fpath, after it was removed or renamed locally.
+func (self *MetaCache) Drop(fpath string) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if e, found := self.nodes[fpath]; found {
+		self.remove(e)
+	}
+}
+
+
+// Rename moves the entry of oldpath, and for a directory every entry below
+// it, to newpath. The nodes move along, so open handles follow the rename.
+// Listings of the directories involved are dropped.
+func (self *MetaCache) Rename(oldpath string, newpath string) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	moved := make(map[string]*cacheEntry)
+	for p, e := range self.nodes {
+		if p == oldpath || strings.HasPrefix(p, oldpath+"/") {
+			moved[newpath+strings.TrimPrefix(p, oldpath)] = e
+		}
+	}
+
+	for p, e := range moved {
+		delete(self.nodes, e.path)
+		if old, found := self.nodes[p]; found {
+			self.remove(old)
+		}
+		e.path = p
+		self.nodes[p] = e
+		if e.node != nil {
+			e.node.lock.Lock()
+			e.node.Path = p
+			e.node.lock.Unlock()
+		}
+	}
+	if _, found := moved[newpath]; !found {
+		if old, found := self.nodes[newpath]; found {
+			self.remove(old)
+		}
+	}
+
+	for p, e := range self.listings {
+		if p == oldpath || strings.HasPrefix(p, oldpath+"/") ||
+			p == newpath || strings.HasPrefix(p, newpath+"/") ||
+			p == path.Dir(oldpath) || p == path.Dir(newpath) {
+			self.remove(e)
+		}
+	}
+}
+
+
+// DropTree forgets everything below directory dpath, after it was deleted.
+func (self *MetaCache) DropTree(dpath string) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for p, e := range self.nodes {
+		if strings.HasPrefix(p, dpath+"/") {
+			self.remove(e)
+		}
+	}
+	for p, e := range self.listings {
+		if p == dpath || strings.HasPrefix(p, dpath+"/") {
+			self.remove(e)
+		}
+	}
+}
+
+
+// Listing returns the cached listing of directory dpath.
+func (self *MetaCache) Listing(dpath string) ([]S3FileObject, bool) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	e, found := self.listings[dpath]
+	if !found {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		self.remove(e)
+		return nil, false
+	}
+	self.lru.MoveToFront(e.elem)
+	return e.entries, true
+}
+
+
+// PutListing caches the complete listing of directory dpath. Listings
+// larger than the whole cache are not kept.
+func (self *MetaCache) PutListing(dpath string, entries []S3FileObject) {
+
+	if self.dirTTL < 0 || len(entries) >= self.size {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if e, found := self.listings[dpath]; found {
+		self.remove(e)
+	}
+	e := &cacheEntry{path: dpath, entries: entries, listing: true}
+	e.expires = time.Now().Add(self.dirTTL)
+	self.add(self.listings, e)
+	self.evict()
+}
+
+
+// Changed invalidates the listing of the directory holding fpath, after
+// something in it was created, removed or written.
+func (self *MetaCache) Changed(fpath string) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if e, found := self.listings[path.Dir(fpath)]; found {
+		self.remove(e)
+	}
+}
+
+
+// add links a new entry into m and the LRU list. Called with the lock held.
+func (self *MetaCache) add(m map[string]*cacheEntry, e *cacheEntry) {
+
+	m[e.path] = e
+	e.elem = self.lru.PushFront(e)
+	self.used += e.weight()
+}
+
+
+// remove unlinks an entry. Called with the lock held.
+func (self *MetaCache) remove(e *cacheEntry) {
+
+	if e.listing {
+		delete(self.listings, e.path)
+	} else {
+		delete(self.nodes, e.path)
+	}
+	self.lru.Remove(e.elem)
+	self.used -= e.weight()
+}
+
+
+// evict drops least recently used entries past the size cap, skipping the
+// nodes that are in use. Called with the lock held.
+func (self *MetaCache) evict() {
+
+	elem := self.lru.Back()
+	for self.used > self.size && elem != nil {
+		prev := elem.Prev()
+		e := elem.Value.(*cacheEntry)
+		if e.node == nil || !e.node.busy() {
+			self.remove(e)
+		}
+		elem = prev
+	}
+}
+
+
+// weight is the number of paths an entry stands for.
+func (self *cacheEntry) weight() int {
+
+	if self.listing {
+		return len(self.entries) + 1
+	}
+	return 1
+}
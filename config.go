@@ -0,0 +1,529 @@
+/*
+ * config.go
+ * Mount configuration: command line flags, config file profiles and -o options
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+
+// S3Config is the full mount configuration. Every field can be set from a
+// config file profile (by its yaml name) or on the command line with
+// "-o name=value"; command line values win over the config file.
+type S3Config struct {
+
+	Bucket     string `yaml:"bucket"`
+	Mountpoint string `yaml:"mountpoint"`
+	Region     string `yaml:"region"`
+	Endpoint   string `yaml:"endpoint"`
+	Prefix     string `yaml:"prefix"`
+
+	// S3-compatible servers, see endpoint.go
+	Addressing       string `yaml:"addressing"`
+	SignatureVersion string `yaml:"signature_version"`
+	CABundle         string `yaml:"ca_bundle"`
+	InsecureTLS      bool   `yaml:"insecure_tls"`
+
+	// keys per ListObjectsV2 call, at most 1000
+	ListPageSize int `yaml:"list_page_size"`
+
+	// sequential read-ahead, see readahead.go
+	NoReadAhead       bool  `yaml:"no_readahead"`
+	ReadAheadChunk    Size  `yaml:"readahead_chunk"`
+	ReadAheadMin      Size  `yaml:"readahead_min"`
+	ReadAheadMax      Size  `yaml:"readahead_max"`
+	ReadAheadParallel int   `yaml:"readahead_parallel"`
+
+	// multipart uploads, see upload.go
+	PartSize          Size  `yaml:"part_size"`
+	UploadConcurrency int   `yaml:"upload_concurrency"`
+
+	// staging files for random writes, see staging.go
+	StagingDir   string `yaml:"staging_dir"`
+	StagingLimit Size   `yaml:"staging_limit"`
+
+	// upload on the last close in the background instead of blocking it;
+	// fsync still waits
+	AsyncWrites bool `yaml:"async_writes"`
+
+	// ownership and permissions reported for every file; uid and gid take
+	// a number or a name and default to the mounting user
+	Uid      string `yaml:"uid"`
+	Gid      string `yaml:"gid"`
+	Umask    uint32 `yaml:"umask"`
+	FileMode uint32 `yaml:"file_mode"`
+	DirMode  uint32 `yaml:"dir_mode"`
+
+	// rmdir of a non-empty directory deletes everything below it instead of
+	// failing with ENOTEMPTY
+	RecursiveRmdir bool `yaml:"recursive_rmdir"`
+
+	// parallel server-side copies, for renames and objects over 5 GB
+	CopyConcurrency int `yaml:"copy_concurrency"`
+
+	// metadata cache, see cache.go; a negative TTL turns that part off
+	StatCacheTTL     time.Duration `yaml:"stat_cache_ttl"`
+	DirCacheTTL      time.Duration `yaml:"dir_cache_ttl"`
+	NegativeCacheTTL time.Duration `yaml:"negative_cache_ttl"`
+	CacheSize        int           `yaml:"cache_size"`
+
+	// retries of failed S3 requests, see retry.go; attempts count the first
+	// one, 1 turns retries off, and a negative timeout turns that one off
+	RetryMaxAttempts int           `yaml:"retry_max_attempts"`
+	RetryBaseDelay   time.Duration `yaml:"retry_base_delay"`
+	RetryMaxDelay    time.Duration `yaml:"retry_max_delay"`
+	RequestTimeout   time.Duration `yaml:"request_timeout"`
+	TotalTimeout     time.Duration `yaml:"total_timeout"`
+
+	// credentials, see NewCredentials for the lookup order
+	SecretAccessKey       string        `yaml:"secret_access_key"`
+	AccessKeyId           string        `yaml:"access_key_id"`
+	SessionToken          string        `yaml:"session_token"`
+	AwsProfile            string        `yaml:"aws_profile"`
+	SharedCredentialsFile string        `yaml:"shared_credentials_file"`
+	RoleARN               string        `yaml:"role_arn"`
+	RoleSessionName       string        `yaml:"role_session_name"`
+	WebIdentityTokenFile  string        `yaml:"web_identity_token_file"`
+	CredentialsEndpoint   string        `yaml:"credentials_endpoint"`
+	MetadataEndpoint      string        `yaml:"metadata_endpoint"`
+	CredentialsRefresh    time.Duration `yaml:"credentials_refresh"`
+
+	// options passed through to FUSE, over the defaults of MountOptions
+	Options []string `yaml:"options"`
+}
+
+
+// ConfigFile is the on-disk layout of the config file, a set of named
+// profiles:
+//
+//	profiles:
+//	  default:
+//	    bucket: swift2
+//	    region: us-west-2
+//	  backup:
+//	    bucket: backups
+//	    prefix: hosts/web1
+//	    options: [ro, allow_other]
+type ConfigFile struct {
+	Profiles map[string]S3Config `yaml:"profiles"`
+}
+
+
+const defaultProfile = "default"
+
+
+// stringList collects a repeatable string flag.
+type stringList []string
+
+func (self *stringList) String() string {
+	return strings.Join(*self, ",")
+}
+
+func (self *stringList) Set(value string) error {
+	*self = append(*self, value)
+	return nil
+}
+
+
+// defaultConfigPath returns the config file used when -config is not given.
+func defaultConfigPath() string {
+
+	if p := os.Getenv("S3FS_CONFIG"); p != "" {
+		return p
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "s3fs", "config.yaml")
+}
+
+
+// ReadConfigFile reads a config file and returns the named profile. A
+// missing file is only an error if it was asked for explicitly.
+func ReadConfigFile(fpath string, profile string, required bool) (S3Config, error) {
+
+	var config S3Config
+
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return config, nil
+		}
+		return config, err
+	}
+
+	file := ConfigFile{}
+	err = yaml.Unmarshal(data, &file)
+	if err != nil {
+		return config, fmt.Errorf("%s: %v", fpath, err)
+	}
+
+	config, found := file.Profiles[profile]
+	if !found && (required || profile != defaultProfile) {
+		return config, fmt.Errorf("%s: no profile %q", fpath, profile)
+	}
+
+	return config, nil
+}
+
+
+// ApplyOption sets the config field whose yaml name matches a single
+// "name=value" (or bare "name" for booleans) mount option. It reports false
+// when the option is not ours, so that it can be handed to FUSE instead.
+func (self *S3Config) ApplyOption(opt string) (bool, error) {
+
+	name, value, hasValue := strings.Cut(opt, "=")
+
+	v := reflect.ValueOf(self).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag != name || tag == "options" {
+			continue
+		}
+
+		field := v.Field(i)
+
+		if !hasValue {
+			if field.Kind() != reflect.Bool {
+				return true, fmt.Errorf("option %s requires a value", name)
+			}
+			value = "true"
+		}
+
+		err := setField(field, value)
+		if err != nil {
+			return true, fmt.Errorf("option %s: %v", name, err)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+
+func setField(field reflect.Value, value string) error {
+
+	// durations are int64 underneath, check them first
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		// base 0 so that modes like 0644 are read as octal
+		n, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return errors.New("unsupported option type")
+	}
+
+	return nil
+}
+
+
+// Size is a byte count that the config file, like -o, may write with a K, M
+// or G suffix.
+type Size int64
+
+
+func (self *Size) UnmarshalYAML(value *yaml.Node) error {
+
+	n, err := parseSize(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", value.Line, err)
+	}
+	*self = Size(n)
+	return nil
+}
+
+
+// parseSize reads an integer with an optional K, M or G (powers of 1024)
+// suffix, so that sizes can be written as 8M rather than 8388608.
+func parseSize(value string) (int64, error) {
+
+	if value == "" {
+		return 0, errors.New("empty value")
+	}
+
+	shift := 0
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift > 0 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n << shift, nil
+}
+
+
+// ApplyOptions sorts a list of comma separated -o strings into config fields
+// and the options that are passed through to FUSE.
+func (self *S3Config) ApplyOptions(opts []string) error {
+
+	for _, list := range opts {
+		for _, opt := range strings.Split(list, ",") {
+
+			opt = strings.TrimSpace(opt)
+			if opt == "" {
+				continue
+			}
+
+			ours, err := self.ApplyOption(opt)
+			if err != nil {
+				return err
+			}
+			if !ours {
+				self.Options = append(self.Options, opt)
+			}
+		}
+	}
+
+	return nil
+}
+
+
+// LoadConfig builds the mount configuration from the command line:
+//
+//	s3fs [flags] [bucket] [mountpoint] [-o options] [fuse args...]
+//
+// The profile from the config file is read first, then flags, positional
+// arguments and -o options override it. Leftover arguments are returned for
+// FUSE.
+func LoadConfig(args []string) (S3Config, []string, error) {
+
+	var config S3Config
+	var opts stringList
+
+	flags := flag.NewFlagSet("s3fs", flag.ContinueOnError)
+	configPath := flags.String("config", "", "config file (default $S3FS_CONFIG or ~/.config/s3fs/config.yaml)")
+	profile := flags.String("profile", defaultProfile, "config file profile")
+	bucket := flags.String("bucket", "", "bucket name")
+	mountpoint := flags.String("mountpoint", "", "mount point")
+	region := flags.String("region", "", "bucket region")
+	endpoint := flags.String("endpoint", "", "S3 endpoint URL")
+	prefix := flags.String("prefix", "", "key prefix to mount as the root")
+	flags.Var(&opts, "o", "mount options, comma separated (repeatable)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return config, nil, err
+	}
+
+	required := *configPath != ""
+	if !required {
+		*configPath = defaultConfigPath()
+	}
+	if *configPath != "" {
+		config, err = ReadConfigFile(*configPath, *profile, required || *profile != defaultProfile)
+		if err != nil {
+			return config, nil, err
+		}
+	}
+
+	// up to two positional arguments; with only one and a bucket already
+	// known from -bucket or the profile, it is the mount point
+	rest := flags.Args()
+	var positional []string
+	for len(rest) > 0 && len(positional) < 2 && !strings.HasPrefix(rest[0], "-") {
+		positional, rest = append(positional, rest[0]), rest[1:]
+	}
+	if len(positional) == 1 && (*bucket != "" || config.Bucket != "") {
+		positional = append([]string{""}, positional...)
+	}
+	if len(positional) > 0 && *bucket == "" {
+		*bucket = positional[0]
+	}
+	if len(positional) > 1 && *mountpoint == "" {
+		*mountpoint = positional[1]
+	}
+
+	// flag stops at the first positional argument: pick out the -o that
+	// follow them, as in "s3fs bucket /mnt -o uid=1000", and leave the rest
+	// for FUSE
+	var fuseArgs []string
+	for i := 0; i < len(rest); i++ {
+		switch {
+		case rest[i] == "-o" && i+1 < len(rest):
+			i++
+			opts = append(opts, rest[i])
+		case strings.HasPrefix(rest[i], "-o") && rest[i] != "-o":
+			opts = append(opts, rest[i][2:])
+		default:
+			fuseArgs = append(fuseArgs, rest[i])
+		}
+	}
+
+	// options from the file are sorted the same way as -o
+	fileOptions := config.Options
+	config.Options = nil
+	err = config.ApplyOptions(append(fileOptions, opts...))
+	if err != nil {
+		return config, nil, err
+	}
+
+
+	override := func(dst *string, value string) {
+		if value != "" {
+			*dst = value
+		}
+	}
+	override(&config.Bucket, *bucket)
+	override(&config.Mountpoint, *mountpoint)
+	override(&config.Region, *region)
+	override(&config.Endpoint, *endpoint)
+	override(&config.Prefix, *prefix)
+
+	if config.Bucket == "" {
+		return config, nil, errors.New("no bucket given")
+	}
+	if config.Mountpoint == "" {
+		return config, nil, errors.New("no mountpoint given")
+	}
+	config.Prefix = strings.Trim(config.Prefix, "/")
+
+	return config, fuseArgs, nil
+}
+
+
+// Defaults for the file_mode and dir_mode options.
+const (
+	defaultFileMode = 0644
+	defaultDirMode  = 0755
+)
+
+
+// Owner resolves the uid and gid options.
+func (self S3Config) Owner() (uint32, uint32, error) {
+
+	uid, err := lookupId(self.Uid, os.Getuid(), func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("uid: %v", err)
+	}
+
+	gid, err := lookupId(self.Gid, os.Getgid(), func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("gid: %v", err)
+	}
+
+	return uid, gid, nil
+}
+
+
+// lookupId reads a numeric id or looks up a name; current is used when
+// value is empty, or -1 as on Windows.
+func lookupId(value string, current int, lookup func(string) (string, error)) (uint32, error) {
+
+	if value == "" {
+		if current < 0 {
+			return 0, nil
+		}
+		return uint32(current), nil
+	}
+
+	if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+		id, err := lookup(value)
+		if err != nil {
+			return 0, err
+		}
+		value = id
+	}
+
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(n), nil
+}
+
+
+// Modes returns the permission bits of files and directories, with the
+// umask applied.
+func (self S3Config) Modes() (uint32, uint32) {
+
+	file := self.FileMode
+	if file == 0 {
+		file = defaultFileMode
+	}
+	dir := self.DirMode
+	if dir == 0 {
+		dir = defaultDirMode
+	}
+	return file &^ self.Umask & 07777, dir &^ self.Umask & 07777
+}
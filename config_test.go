@@ -0,0 +1,78 @@
+/*
+ * config_test.go
+ * The example config file and the command line
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+
+// every profile of the example file loads
+func TestExampleConfig(t *testing.T) {
+
+	data, err := ioutil.ReadFile("s3fs.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := ConfigFile{}
+	err = yaml.Unmarshal(data, &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Profiles) == 0 {
+		t.Fatal("no profiles")
+	}
+
+	for name := range file.Profiles {
+		_, err := ReadConfigFile("s3fs.example.yaml", name, true)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	media := file.Profiles["media"]
+	if media.ReadAheadChunk != 8<<20 || media.ReadAheadMax != 256<<20 {
+		t.Errorf("media: readahead_chunk %d, readahead_max %d", media.ReadAheadChunk, media.ReadAheadMax)
+	}
+}
+
+
+func TestLoadConfig(t *testing.T) {
+
+	t.Setenv("S3FS_CONFIG", filepath.Join(t.TempDir(), "missing.yaml"))
+
+	// -o after the bucket and mount point
+	config, rest, err := LoadConfig([]string{"bucket", "/mnt", "-o", "uid=1000,readahead_max=64M,allow_other", "-f"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Bucket != "bucket" || config.Mountpoint != "/mnt" {
+		t.Errorf("bucket %q, mountpoint %q", config.Bucket, config.Mountpoint)
+	}
+	if config.Uid != "1000" || config.ReadAheadMax != 64<<20 {
+		t.Errorf("uid %q, readahead_max %d", config.Uid, config.ReadAheadMax)
+	}
+	if !reflect.DeepEqual(config.Options, []string{"allow_other"}) || !reflect.DeepEqual(rest, []string{"-f"}) {
+		t.Errorf("mount options %q, FUSE arguments %q", config.Options, rest)
+	}
+
+	_, _, err = LoadConfig([]string{"bucket"})
+	if err == nil {
+		t.Error("no error without a mount point")
+	}
+}
@@ -0,0 +1,863 @@
+//go:build linux && integration
+// +build linux,integration
+
+/*
+ * conformance_test.go
+ * POSIX conformance scenarios run through a real FUSE mount on Linux
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// go test -tags integration -run Conformance [-args -mountpoint dir -o options]
+var (
+	conformanceMountpoint = flag.String("mountpoint", "", "empty directory to mount on (default a temporary one)")
+	conformanceWait       = flag.Duration("mount_timeout", 10*time.Second, "how long to wait for the mount")
+	conformanceOptions    stringList
+)
+
+
+func init() {
+
+	flag.Var(&conformanceOptions, "o", "mount options, comma separated (repeatable)")
+}
+
+
+// conformanceCase is the state of one scenario: its own directory in the
+// mount, and the store behind it, to check what reached the bucket.
+type conformanceCase struct {
+
+	dir  string
+	name string
+	mem  *MemStore
+}
+
+
+// conformanceScenario is one POSIX behavior. Required ones must hold;
+// optional ones are reported as supported or not, and never fail the run.
+type conformanceScenario struct {
+
+	name     string
+	optional bool
+	run      func(c *conformanceCase) error
+}
+
+
+// TestConformance mounts S3fs through libfuse on the fake S3 server and runs
+// the scenarios against the mount with ordinary system calls. Optional
+// scenarios that do not hold are skipped as not supported.
+func TestConformance(t *testing.T) {
+
+	config := testConfig()
+	config.ListPageSize = 100
+	config.RequestTimeout = 5 * time.Second
+	err := config.ApplyOptions(conformanceOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mountpoint := *conformanceMountpoint
+	if mountpoint == "" {
+		mountpoint = t.TempDir()
+	}
+
+	mem := NewMemStore()
+	fake, err := StartFakeS3(mem, config.Bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	config.Endpoint = fake.URL()
+
+	client, err := NewClient(config.Bucket, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3fs, err := NewS3fs(client, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := fuse.NewFileSystemHost(s3fs)
+	host.SetCapReaddirPlus(true)
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- host.Mount(mountpoint, MountOptions(config))
+	}()
+	// Destroy waits for the uploads still running
+	defer func() {
+		host.Unmount()
+		<-done
+		if mem.Uploads() != 0 {
+			t.Errorf("%d multipart uploads left behind", mem.Uploads())
+		}
+	}()
+	err = waitMounted(mountpoint, *conformanceWait, done)
+	if err != nil {
+		t.Fatal("mount:", err)
+	}
+
+	for _, scenario := range conformanceScenarios {
+		scenario := scenario
+		t.Run(scenario.name, func(t *testing.T) {
+			c := &conformanceCase{dir: filepath.Join(mountpoint, scenario.name), name: scenario.name, mem: mem}
+			err := os.Mkdir(c.dir, 0755)
+			if err == nil {
+				err = scenario.run(c)
+			}
+			switch {
+			case err == nil:
+			case scenario.optional:
+				t.Skip("not supported:", err)
+			default:
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+
+// waitMounted returns once mountpoint is on another device than its parent,
+// or with an error if Mount returned first or the time is up. The result of
+// Mount is left in done.
+func waitMounted(mountpoint string, timeout time.Duration, done chan bool) error {
+
+	var parent syscall.Stat_t
+	err := syscall.Stat(filepath.Dir(mountpoint), &parent)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.After(timeout)
+	for {
+		var stat syscall.Stat_t
+		if syscall.Stat(mountpoint, &stat) == nil && stat.Dev != parent.Dev {
+			return nil
+		}
+		select {
+		case ok := <-done:
+			done <- ok
+			return fmt.Errorf("%s: mount failed", mountpoint)
+		case <-deadline:
+			return fmt.Errorf("%s: not mounted after %v", mountpoint, timeout)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+
+func (self *conformanceCase) path(name string) string {
+
+	return filepath.Join(self.dir, name)
+}
+
+
+// stored checks that name reached the bucket with size bytes.
+func (self *conformanceCase) stored(name string, size int64) error {
+
+	info, err := self.mem.Head(self.name + "/" + name)
+	if err != nil {
+		return fmt.Errorf("%s: not in the bucket: %v", name, err)
+	}
+	if info.Size != size {
+		return fmt.Errorf("%s: %d bytes in the bucket, want %d", name, info.Size, size)
+	}
+	return nil
+}
+
+
+func (self *conformanceCase) expectFile(name string, want []byte) error {
+
+	got, err := os.ReadFile(self.path(name))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		if len(got) < 64 && len(want) < 64 {
+			return fmt.Errorf("%s: read %q, want %q", name, got, want)
+		}
+		return fmt.Errorf("%s: %d bytes read differ from the %d expected", name, len(got), len(want))
+	}
+	stat, err := os.Stat(self.path(name))
+	if err != nil {
+		return err
+	}
+	if stat.Size() != int64(len(want)) {
+		return fmt.Errorf("%s: size %d, want %d", name, stat.Size(), len(want))
+	}
+	return nil
+}
+
+
+func expectErr(err error, target error, what string) error {
+
+	if !errors.Is(err, target) {
+		return fmt.Errorf("%s: got %v, want %v", what, err, target)
+	}
+	return nil
+}
+
+
+// writeFiles writes each name with its contents, stopping at the first error.
+func (self *conformanceCase) writeFiles(files ...string) error {
+
+	for i := 0; i+1 < len(files); i += 2 {
+		err := os.WriteFile(self.path(files[i]), []byte(files[i+1]), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+
+var conformanceScenarios = []conformanceScenario{
+
+	{name: "create-write-read", run: func(c *conformanceCase) error {
+		err := c.writeFiles("a.txt", "hello")
+		if err != nil {
+			return err
+		}
+		stat, err := os.Stat(c.path("a.txt"))
+		if err != nil {
+			return err
+		}
+		if !stat.Mode().IsRegular() {
+			return fmt.Errorf("mode %v is not a regular file", stat.Mode())
+		}
+		if err := c.expectFile("a.txt", []byte("hello")); err != nil {
+			return err
+		}
+		return c.stored("a.txt", 5)
+	}},
+
+	{name: "create-empty", run: func(c *conformanceCase) error {
+		f, err := os.Create(c.path("empty"))
+		if err != nil {
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+		if err := c.expectFile("empty", nil); err != nil {
+			return err
+		}
+		return c.stored("empty", 0)
+	}},
+
+	{name: "overwrite", run: func(c *conformanceCase) error {
+		err := c.writeFiles("f", "a longer first version", "f", "short")
+		if err != nil {
+			return err
+		}
+		if err := c.expectFile("f", []byte("short")); err != nil {
+			return err
+		}
+		return c.stored("f", 5)
+	}},
+
+	{name: "exclusive-create", run: func(c *conformanceCase) error {
+		err := c.writeFiles("x", "x")
+		if err != nil {
+			return err
+		}
+		_, err = os.OpenFile(c.path("x"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		return expectErr(err, fs.ErrExist, "O_EXCL on an existing file")
+	}},
+
+	{name: "append", run: func(c *conformanceCase) error {
+		err := c.writeFiles("log", "one\n")
+		if err != nil {
+			return err
+		}
+		for _, line := range []string{"two\n", "three\n"} {
+			f, err := os.OpenFile(c.path("log"), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteString(line)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return c.expectFile("log", []byte("one\ntwo\nthree\n"))
+	}},
+
+	{name: "pwrite", run: func(c *conformanceCase) error {
+		f, err := os.OpenFile(c.path("r"), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		for _, w := range []struct {
+			off  int64
+			data string
+		}{{6, "world"}, {0, "hello "}, {20, "!"}} {
+			_, err = f.WriteAt([]byte(w.data), w.off)
+			if err != nil {
+				return err
+			}
+		}
+		want := []byte("hello world\x00\x00\x00\x00\x00\x00\x00\x00\x00!")
+		got := make([]byte, 64)
+		n, err := f.ReadAt(got, 0)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if !bytes.Equal(got[:n], want) {
+			return fmt.Errorf("read back through the handle %q, want %q", got[:n], want)
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+		return c.expectFile("r", want)
+	}},
+
+	{name: "rename", run: func(c *conformanceCase) error {
+		err := c.writeFiles("a", "a", "b", "b")
+		if err == nil {
+			err = os.Rename(c.path("a"), c.path("c"))
+		}
+		if err != nil {
+			return err
+		}
+		_, err = os.Stat(c.path("a"))
+		if err := expectErr(err, fs.ErrNotExist, "stat of the old name"); err != nil {
+			return err
+		}
+		if err := c.expectFile("c", []byte("a")); err != nil {
+			return err
+		}
+		// onto an existing file, which is replaced
+		err = os.Rename(c.path("c"), c.path("b"))
+		if err != nil {
+			return err
+		}
+		if err := c.expectFile("b", []byte("a")); err != nil {
+			return err
+		}
+		return c.stored("b", 1)
+	}},
+
+	{name: "rename-dir", run: func(c *conformanceCase) error {
+		err := os.MkdirAll(c.path("src/sub"), 0755)
+		if err == nil {
+			err = c.writeFiles("src/x", "x", "src/sub/y", "y")
+		}
+		if err == nil {
+			err = os.Rename(c.path("src"), c.path("dst"))
+		}
+		if err != nil {
+			return err
+		}
+		_, err = os.Stat(c.path("src"))
+		if err := expectErr(err, fs.ErrNotExist, "stat of the old directory"); err != nil {
+			return err
+		}
+		if err := c.expectFile("dst/x", []byte("x")); err != nil {
+			return err
+		}
+		if err := c.expectFile("dst/sub/y", []byte("y")); err != nil {
+			return err
+		}
+		return c.stored("dst/sub/y", 1)
+	}},
+
+	{name: "unlink", run: func(c *conformanceCase) error {
+		err := c.writeFiles("gone", "gone", "kept", "kept")
+		if err == nil {
+			err = os.Remove(c.path("gone"))
+		}
+		if err != nil {
+			return err
+		}
+		_, err = os.Stat(c.path("gone"))
+		if err := expectErr(err, fs.ErrNotExist, "stat after unlink"); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(c.dir)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 1 || entries[0].Name() != "kept" {
+			return fmt.Errorf("listing after unlink: %v", entries)
+		}
+		_, err = c.mem.Head(c.name + "/gone")
+		if err == nil {
+			return fmt.Errorf("still in the bucket")
+		}
+		return nil
+	}},
+
+	// an unlinked file stays readable through handles open on it
+	{name: "unlink-open", optional: true, run: func(c *conformanceCase) error {
+		err := c.writeFiles("f", "still here")
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(c.path("f"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		err = os.Remove(c.path("f"))
+		if err != nil {
+			return err
+		}
+		got, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if string(got) != "still here" {
+			return fmt.Errorf("read %q after unlink", got)
+		}
+		return nil
+	}},
+
+	{name: "mkdir-rmdir", run: func(c *conformanceCase) error {
+		err := os.Mkdir(c.path("d"), 0755)
+		if err == nil {
+			err = c.writeFiles("d/f", "f")
+		}
+		if err != nil {
+			return err
+		}
+		stat, err := os.Stat(c.path("d"))
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("mode %v is not a directory", stat.Mode())
+		}
+		err = os.Mkdir(c.path("d"), 0755)
+		if err := expectErr(err, fs.ErrExist, "mkdir of an existing directory"); err != nil {
+			return err
+		}
+		err = syscall.Rmdir(c.path("d"))
+		if err := expectErr(err, syscall.ENOTEMPTY, "rmdir of a non-empty directory"); err != nil {
+			return err
+		}
+		err = syscall.Rmdir(c.path("d/f"))
+		if err := expectErr(err, syscall.ENOTDIR, "rmdir of a file"); err != nil {
+			return err
+		}
+		err = os.Remove(c.path("d/f"))
+		if err == nil {
+			err = syscall.Rmdir(c.path("d"))
+		}
+		if err != nil {
+			return err
+		}
+		_, err = os.Stat(c.path("d"))
+		return expectErr(err, fs.ErrNotExist, "stat after rmdir")
+	}},
+
+	// more entries than one listing page
+	{name: "readdir", run: func(c *conformanceCase) error {
+		const n = 250
+		for i := 0; i < n; i++ {
+			err := os.WriteFile(c.path(fmt.Sprintf("f%03d", i)), make([]byte, i%10), 0644)
+			if err != nil {
+				return err
+			}
+		}
+		err := os.Mkdir(c.path("sub"), 0755)
+		if err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(c.dir)
+		if err != nil {
+			return err
+		}
+		if len(entries) != n+1 {
+			return fmt.Errorf("%d entries, want %d", len(entries), n+1)
+		}
+		for i, entry := range entries[:n] {
+			if entry.Name() != fmt.Sprintf("f%03d", i) || !entry.Type().IsRegular() {
+				return fmt.Errorf("entry %d is %s, %v", i, entry.Name(), entry.Type())
+			}
+		}
+		if !entries[n].IsDir() {
+			return fmt.Errorf("%s is not a directory", entries[n].Name())
+		}
+		return nil
+	}},
+
+	{name: "truncate", run: func(c *conformanceCase) error {
+		err := c.writeFiles("t", "0123456789")
+		if err != nil {
+			return err
+		}
+		for _, step := range []struct {
+			size int64
+			want string
+		}{{4, "0123"}, {8, "0123\x00\x00\x00\x00"}, {0, ""}} {
+			err = os.Truncate(c.path("t"), step.size)
+			if err != nil {
+				return err
+			}
+			if err := c.expectFile("t", []byte(step.want)); err != nil {
+				return err
+			}
+		}
+		return c.stored("t", 0)
+	}},
+
+	{name: "ftruncate", run: func(c *conformanceCase) error {
+		f, err := os.OpenFile(c.path("t"), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteString("abcdef")
+		if err == nil {
+			err = f.Truncate(3)
+		}
+		if err == nil {
+			_, err = f.WriteAt([]byte("!"), 5)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		return c.expectFile("t", []byte("abc\x00\x00!"))
+	}},
+
+	{name: "chmod", run: func(c *conformanceCase) error {
+		err := c.writeFiles("m", "m")
+		if err == nil {
+			err = os.Chmod(c.path("m"), 0640)
+		}
+		if err != nil {
+			return err
+		}
+		stat, err := os.Stat(c.path("m"))
+		if err != nil {
+			return err
+		}
+		if stat.Mode().Perm() != 0640 {
+			return fmt.Errorf("mode %v, want 0640", stat.Mode())
+		}
+		return nil
+	}},
+
+	{name: "chown", run: func(c *conformanceCase) error {
+		err := c.writeFiles("o", "o")
+		if err != nil {
+			return err
+		}
+		// to someone else only as root, to ourselves otherwise
+		uid, gid := os.Getuid(), os.Getgid()
+		if uid == 0 {
+			uid, gid = 4242, 4343
+		}
+		err = os.Chown(c.path("o"), uid, gid)
+		if err != nil {
+			return err
+		}
+		stat, err := os.Stat(c.path("o"))
+		if err != nil {
+			return err
+		}
+		sys := stat.Sys().(*syscall.Stat_t)
+		if int(sys.Uid) != uid || int(sys.Gid) != gid {
+			return fmt.Errorf("owner %d:%d, want %d:%d", sys.Uid, sys.Gid, uid, gid)
+		}
+		return nil
+	}},
+
+	{name: "utimes", run: func(c *conformanceCase) error {
+		err := c.writeFiles("u", "u")
+		if err != nil {
+			return err
+		}
+		mtime := time.Date(2020, 2, 2, 12, 0, 0, 0, time.UTC)
+		err = os.Chtimes(c.path("u"), mtime, mtime)
+		if err != nil {
+			return err
+		}
+		stat, err := os.Stat(c.path("u"))
+		if err != nil {
+			return err
+		}
+		if !stat.ModTime().Equal(mtime) {
+			return fmt.Errorf("mtime %v, want %v", stat.ModTime(), mtime)
+		}
+		return nil
+	}},
+
+	{name: "fsync", run: func(c *conformanceCase) error {
+		f, err := os.Create(c.path("s"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.WriteString("synced")
+		if err == nil {
+			err = f.Sync()
+		}
+		if err != nil {
+			return err
+		}
+		// stored before the file is closed
+		return c.stored("s", 6)
+	}},
+
+	{name: "concurrent-writers", run: func(c *conformanceCase) error {
+		const writers = 8
+		errs := make(chan error, writers)
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- os.WriteFile(c.path(fmt.Sprintf("w%d", i)), conformanceData(i, 1<<20), 0644)
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		for i := 0; i < writers; i++ {
+			if err := c.expectFile(fmt.Sprintf("w%d", i), conformanceData(i, 1<<20)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+
+	// several threads writing disjoint ranges of one open file
+	{name: "concurrent-pwrite", optional: true, run: func(c *conformanceCase) error {
+		const writers, chunk = 4, 256 << 10
+		f, err := os.Create(c.path("shared"))
+		if err != nil {
+			return err
+		}
+		want := conformanceData(7, writers*chunk)
+		errs := make(chan error, writers)
+		var wg sync.WaitGroup
+		for i := writers - 1; i >= 0; i-- {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := f.WriteAt(want[i*chunk:(i+1)*chunk], int64(i*chunk))
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		err = f.Close()
+		for werr := range errs {
+			if werr != nil {
+				err = werr
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return c.expectFile("shared", want)
+	}},
+
+	{name: "large-file", run: func(c *conformanceCase) error {
+		want := conformanceData(3, 3*minPartSize+12345)
+		f, err := os.Create(c.path("big"))
+		if err != nil {
+			return err
+		}
+		// in write(2) sized pieces, as cp does
+		_, err = io.CopyBuffer(f, bytes.NewReader(want), make([]byte, 128<<10))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+
+		f, err = os.Open(c.path("big"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		off := int64(2*minPartSize - 100)
+		got := make([]byte, 4096)
+		_, err = f.ReadAt(got, off)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want[off:off+4096]) {
+			return fmt.Errorf("read across a part boundary differs")
+		}
+		sum := sha256.New()
+		_, err = io.Copy(sum, io.NewSectionReader(f, 0, 1<<62))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(sum.Sum(nil), sha256sum(want)) {
+			return fmt.Errorf("contents differ")
+		}
+
+		info, err := c.mem.Head(c.name + "/big")
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(info.ETag, "-") {
+			return fmt.Errorf("ETag %s is not from a multipart upload", info.ETag)
+		}
+		return nil
+	}},
+
+	{name: "deep-tree", run: func(c *conformanceCase) error {
+		const depth = 16
+		dir := c.dir
+		for i := 0; i < depth; i++ {
+			dir = filepath.Join(dir, fmt.Sprintf("d%02d", i))
+			err := os.Mkdir(dir, 0755)
+			if err == nil {
+				err = os.WriteFile(filepath.Join(dir, "f"), []byte(dir), 0644)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		dirs, files := 0, 0
+		err := filepath.WalkDir(c.path("d00"), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				dirs++
+				return nil
+			}
+			files++
+			data, err := os.ReadFile(path)
+			if err == nil && string(data) != filepath.Dir(path) {
+				err = fmt.Errorf("%s: read %q", path, data)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if dirs != depth || files != depth {
+			return fmt.Errorf("walked %d directories and %d files, want %d of each", dirs, files, depth)
+		}
+
+		err = os.RemoveAll(c.path("d00"))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stat(c.path("d00"))
+		return expectErr(err, fs.ErrNotExist, "stat after removing the tree")
+	}},
+
+	{name: "statfs", run: func(c *conformanceCase) error {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(c.dir, &stat)
+		if err != nil {
+			return err
+		}
+		if stat.Bsize <= 0 || stat.Blocks == 0 || stat.Namelen < 255 {
+			return fmt.Errorf("block size %d, %d blocks, names up to %d", stat.Bsize, stat.Blocks, stat.Namelen)
+		}
+		return nil
+	}},
+
+	{name: "symlink", optional: true, run: func(c *conformanceCase) error {
+		err := c.writeFiles("target", "t")
+		if err == nil {
+			err = os.Symlink("target", c.path("link"))
+		}
+		if err != nil {
+			return err
+		}
+		target, err := os.Readlink(c.path("link"))
+		if err != nil {
+			return err
+		}
+		if target != "target" {
+			return fmt.Errorf("link to %q", target)
+		}
+		return c.expectFile("link", []byte("t"))
+	}},
+
+	{name: "hardlink", optional: true, run: func(c *conformanceCase) error {
+		err := c.writeFiles("a", "a")
+		if err == nil {
+			err = os.Link(c.path("a"), c.path("b"))
+		}
+		if err != nil {
+			return err
+		}
+		return c.expectFile("b", []byte("a"))
+	}},
+
+	{name: "mkfifo", optional: true, run: func(c *conformanceCase) error {
+		err := syscall.Mkfifo(c.path("fifo"), 0644)
+		if err != nil {
+			return err
+		}
+		stat, err := os.Stat(c.path("fifo"))
+		if err != nil {
+			return err
+		}
+		if stat.Mode()&fs.ModeNamedPipe == 0 {
+			return fmt.Errorf("mode %v is not a named pipe", stat.Mode())
+		}
+		return nil
+	}},
+}
+
+
+// conformanceData is n bytes that differ between seeds and along the file.
+func conformanceData(seed int, n int) []byte {
+
+	data := pattern(n)
+	for i := range data {
+		data[i] ^= byte(seed)
+	}
+	return data
+}
+
+
+func sha256sum(data []byte) []byte {
+
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
@@ -0,0 +1,148 @@
+/*
+ * copy.go
+ * Server-side object copies, multipart for objects over 5 GB
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+
+// CopyObject takes objects up to 5 GB; larger ones are copied part by part.
+const maxCopyObjectSize = 5 << 30
+
+// smallest part of a multipart copy; parts grow to stay within 10000
+const copyPartSize = 512 << 20
+
+// default for the copy_concurrency option
+const defaultCopyConcurrency = 8
+
+// copyObject copies src to dst inside the bucket without passing the data
+// through this host. With metadata nil the object keeps its own metadata,
+// otherwise it is replaced; head, from Head of src, may be nil and is then
+// fetched when needed. It returns the new ETag and modification time.
+func (self *S3) copyObject(src string, dst string, size int64, head *ObjectInfo, metadata map[string]*string) (string, time.Time, error) {
+
+	if metadata == nil && size <= maxCopyObjectSize {
+		info, err := self.store.Copy(src, dst, nil)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return info.ETag, info.LastModified, nil
+	}
+
+	if head == nil {
+		info, err := self.store.Head(src)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		head = &info
+		size = info.Size
+	}
+	if metadata == nil {
+		metadata = head.Metadata
+	}
+
+	if size > maxCopyObjectSize {
+		return self.multipartCopy(src, dst, size, head, metadata)
+	}
+
+	info, err := self.store.Copy(src, dst, &PutOptions{Metadata: metadata, ContentHeaders: head.ContentHeaders})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return info.ETag, info.LastModified, nil
+}
+
+
+// multipartCopy copies bytes [0, size) of src with UploadPartCopy,
+// copy_concurrency parts at a time. The upload is aborted if any part fails.
+func (self *S3) multipartCopy(src string, dst string, size int64, head *ObjectInfo, metadata map[string]*string) (string, time.Time, error) {
+
+	uploadId, err := self.store.CreateMultipart(dst, PutOptions{Metadata: metadata, ContentHeaders: head.ContentHeaders})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	partSize := int64(copyPartSize)
+	if size/partSize >= 10000 {
+		partSize = size/9999 + 1
+	}
+
+	var lock sync.Mutex
+	var parts []Part
+	var failed error
+
+	sem := make(chan struct{}, self.copyConcurrency())
+	var wg sync.WaitGroup
+
+	for n, off := int64(1), int64(0); off < size; n, off = n+1, off+partSize {
+
+		end := off + partSize
+		if end > size {
+			end = size
+		}
+
+		sem <- struct{}{}
+		lock.Lock()
+		stop := failed != nil
+		lock.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(n int64, off int64, end int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			etag, err := self.store.UploadPartCopy(dst, uploadId, n, src, off, end)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				if failed == nil {
+					failed = err
+				}
+				return
+			}
+			parts = append(parts, Part{Number: n, ETag: etag})
+		}(n, off, end)
+	}
+	wg.Wait()
+
+	if failed == nil {
+		sort.Slice(parts, func(i, j int) bool {
+			return parts[i].Number < parts[j].Number
+		})
+		info, err := self.store.CompleteMultipart(dst, uploadId, parts)
+		if err == nil {
+			return info.ETag, info.LastModified, nil
+		}
+		failed = err
+	}
+
+	self.store.AbortMultipart(dst, uploadId)
+	return "", time.Time{}, failed
+}
+
+
+func (self *S3) copyConcurrency() int {
+
+	if self.config.CopyConcurrency > 0 {
+		return self.config.CopyConcurrency
+	}
+	return defaultCopyConcurrency
+}
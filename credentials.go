@@ -0,0 +1,173 @@
+/*
+ * credentials.go
+ * AWS credential provider chain
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+
+// ECS/EKS task role endpoint used with AWS_CONTAINER_CREDENTIALS_RELATIVE_URI
+const containerCredentialsHost = "http://169.254.170.2"
+
+// refresh temporary credentials this long before they expire
+const credentialsExpiryWindow = 5 * time.Minute
+
+// how often long-lived keys are re-read when credentials_refresh is not set
+const defaultCredentialsRefresh = 15 * time.Minute
+
+// the SDK's timeout and retries for instance metadata, set here because it
+// drops them once AWS_CA_BUNDLE has modified the default HTTP client
+const metadataTimeout = time.Second
+const metadataRetries = 2
+
+
+// refreshProvider re-reads a provider that never expires on its own (the
+// environment, the shared credentials file) every interval, so that rotated
+// keys are picked up without remounting.
+type refreshProvider struct {
+	credentials.Provider
+	interval  time.Duration
+	retrieved time.Time
+}
+
+func (self *refreshProvider) Retrieve() (credentials.Value, error) {
+
+	value, err := self.Provider.Retrieve()
+	if err == nil {
+		self.retrieved = time.Now()
+	}
+	return value, err
+}
+
+func (self *refreshProvider) IsExpired() bool {
+	return self.Provider.IsExpired() || time.Since(self.retrieved) > self.interval
+}
+
+
+// NewCredentials returns the credential chain used by NewClient, first match
+// wins:
+//
+//  1. access_key_id/secret_access_key from the mount config
+//  2. AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY/AWS_SESSION_TOKEN
+//  3. web identity token file (role_arn + web_identity_token_file, or
+//     AWS_ROLE_ARN + AWS_WEB_IDENTITY_TOKEN_FILE)
+//  4. shared credentials file profile (aws_profile or AWS_PROFILE)
+//  5. container credentials endpoint (credentials_endpoint or
+//     AWS_CONTAINER_CREDENTIALS_FULL_URI/RELATIVE_URI)
+//  6. EC2 instance metadata (metadata_endpoint overrides the address)
+//
+// Temporary credentials are refreshed before they expire.
+func NewCredentials(sess *session.Session, config S3Config) *credentials.Credentials {
+
+	var providers []credentials.Provider
+
+	// sess carries the S3 endpoint of a custom server; STS and instance
+	// metadata resolve their own
+	sess = sess.Copy(&aws.Config{Endpoint: aws.String("")})
+
+	refresh := config.CredentialsRefresh
+	if refresh <= 0 {
+		refresh = defaultCredentialsRefresh
+	}
+
+	// static keys from the config
+	if config.AccessKeyId != "" && config.SecretAccessKey != "" {
+		providers = append(providers, &credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     config.AccessKeyId,
+			SecretAccessKey: config.SecretAccessKey,
+			SessionToken:    config.SessionToken,
+		}})
+	}
+
+	// environment
+	providers = append(providers, &refreshProvider{Provider: &credentials.EnvProvider{}, interval: refresh})
+
+	// web identity
+	roleARN := firstNonEmpty(config.RoleARN, os.Getenv("AWS_ROLE_ARN"))
+	tokenFile := firstNonEmpty(config.WebIdentityTokenFile, os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if roleARN != "" && tokenFile != "" {
+		sessionName := firstNonEmpty(config.RoleSessionName, os.Getenv("AWS_ROLE_SESSION_NAME"), "s3fs")
+		provider := stscreds.NewWebIdentityRoleProviderWithOptions(sts.New(sess), roleARN, sessionName,
+			stscreds.FetchTokenPath(tokenFile), func(p *stscreds.WebIdentityRoleProvider) {
+				p.ExpiryWindow = credentialsExpiryWindow
+			})
+		providers = append(providers, provider)
+	}
+
+	// shared credentials file
+	providers = append(providers, &refreshProvider{
+		Provider: &credentials.SharedCredentialsProvider{
+			Filename: config.SharedCredentialsFile,
+			Profile:  config.AwsProfile,
+		},
+		interval: refresh,
+	})
+
+	// container endpoint
+	endpoint := config.CredentialsEndpoint
+	if endpoint == "" {
+		if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+			endpoint = uri
+		} else if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+			endpoint = containerCredentialsHost + uri
+		}
+	}
+	if endpoint != "" {
+		providers = append(providers, endpointcreds.NewProviderClient(*sess.Config, sess.Handlers, endpoint,
+			func(p *endpointcreds.Provider) {
+				p.ExpiryWindow = credentialsExpiryWindow
+				p.AuthorizationToken = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+			}))
+	}
+
+	// instance metadata
+	metadataConfig := &aws.Config{
+		HTTPClient: &http.Client{Timeout: metadataTimeout},
+		MaxRetries: aws.Int(metadataRetries),
+	}
+	if config.MetadataEndpoint != "" {
+		metadataConfig.Endpoint = aws.String(config.MetadataEndpoint)
+	}
+	providers = append(providers, &ec2rolecreds.EC2RoleProvider{
+		Client:       ec2metadata.New(sess, metadataConfig),
+		ExpiryWindow: credentialsExpiryWindow,
+	})
+
+	return credentials.NewCredentials(&credentials.ChainProvider{
+		Providers:     providers,
+		VerboseErrors: true,
+	})
+}
+
+
+func firstNonEmpty(values ...string) string {
+
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
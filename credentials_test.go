@@ -0,0 +1,235 @@
+/*
+ * credentials_test.go
+ * The credential chain against local stand-ins for the AWS endpoints
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+
+// fakeCredentials serves temporary keys as the container credentials
+// endpoint and EC2 instance metadata do. Every request for keys gets new
+// ones, named after the server and a count, that expire after ttl.
+type fakeCredentials struct {
+
+	name   string
+	ttl    time.Duration
+	served int32
+	server *httptest.Server
+}
+
+
+func startFakeCredentials(t *testing.T, name string, ttl time.Duration) *fakeCredentials {
+
+	fake := &fakeCredentials{name: name, ttl: ttl}
+	mux := http.NewServeMux()
+	// container endpoint
+	mux.HandleFunc("/creds", fake.keys)
+	// instance metadata, IMDSv2
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+		fmt.Fprint(w, "token")
+	})
+	mux.HandleFunc("/latest/meta-data/iam/security-credentials/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "role\n")
+	})
+	mux.HandleFunc("/latest/meta-data/iam/security-credentials/role", fake.keys)
+
+	fake.server = httptest.NewServer(mux)
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+
+func (self *fakeCredentials) keys(w http.ResponseWriter, r *http.Request) {
+
+	n := atomic.AddInt32(&self.served, 1)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Code":            "Success",
+		"AccessKeyId":     fmt.Sprintf("%s-%d", self.name, n),
+		"SecretAccessKey": "secret",
+		"Token":           "token",
+		"Expiration":      time.Now().Add(self.ttl).UTC().Format(time.RFC3339),
+	})
+}
+
+
+// isolateCredentials hides the credentials of the machine running the test.
+func isolateCredentials(t *testing.T) {
+
+	for _, name := range []string{
+		"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY",
+		"AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_EC2_METADATA_DISABLED",
+	} {
+		t.Setenv(name, "")
+	}
+	dir := t.TempDir()
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+}
+
+
+func credentialsSession(t *testing.T) *session.Session {
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+
+func expectKey(t *testing.T, config S3Config, want string) {
+
+	t.Helper()
+	value, err := NewCredentials(credentialsSession(t), config).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != want {
+		t.Fatalf("key %q from %s, want %q", value.AccessKeyID, value.ProviderName, want)
+	}
+}
+
+
+// each source wins over the ones after it
+func TestCredentialsChain(t *testing.T) {
+
+	isolateCredentials(t)
+	container := startFakeCredentials(t, "container", time.Hour)
+	metadata := startFakeCredentials(t, "metadata", time.Hour)
+
+	config := S3Config{
+		AccessKeyId:         "static",
+		SecretAccessKey:     "secret",
+		CredentialsEndpoint: container.server.URL + "/creds",
+		MetadataEndpoint:    metadata.server.URL,
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "env")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	shared := "[default]\naws_access_key_id = shared\naws_secret_access_key = secret\n"
+	err := os.WriteFile(os.Getenv("AWS_SHARED_CREDENTIALS_FILE"), []byte(shared), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectKey(t, config, "static")
+
+	config.AccessKeyId, config.SecretAccessKey = "", ""
+	expectKey(t, config, "env")
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	expectKey(t, config, "shared")
+
+	os.Remove(os.Getenv("AWS_SHARED_CREDENTIALS_FILE"))
+	expectKey(t, config, "container-1")
+
+	// the variable the container runtime sets, when the config has none
+	config.CredentialsEndpoint = ""
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", container.server.URL+"/creds")
+	expectKey(t, config, "container-2")
+
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	expectKey(t, config, "metadata-1")
+}
+
+
+// temporary keys are fetched again as they come within the expiry window,
+// long-lived ones every credentials_refresh
+func TestCredentialsRefresh(t *testing.T) {
+
+	isolateCredentials(t)
+	ttl := credentialsExpiryWindow + time.Second
+
+	for _, source := range []string{"container", "metadata"} {
+		fake := startFakeCredentials(t, source, ttl)
+		config := S3Config{MetadataEndpoint: fake.server.URL}
+		if source == "container" {
+			config.CredentialsEndpoint = fake.server.URL + "/creds"
+		}
+		creds := NewCredentials(credentialsSession(t), config)
+
+		for i, want := range []string{"-1", "-1", "-2"} {
+			if i == 2 {
+				time.Sleep(ttl - credentialsExpiryWindow + 100*time.Millisecond)
+			}
+			value, err := creds.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value.AccessKeyID != source+want {
+				t.Fatalf("%s: key %q, want %q", source, value.AccessKeyID, source+want)
+			}
+		}
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "old")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	creds := NewCredentials(credentialsSession(t), S3Config{CredentialsRefresh: 50 * time.Millisecond})
+	value, err := creds.Get()
+	if err != nil || value.AccessKeyID != "old" {
+		t.Fatalf("key %q, %v", value.AccessKeyID, err)
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "rotated")
+	time.Sleep(100 * time.Millisecond)
+	value, err = creds.Get()
+	if err != nil || value.AccessKeyID != "rotated" {
+		t.Fatalf("key %q after rotation, %v", value.AccessKeyID, err)
+	}
+}
+
+
+// where nothing answers at the metadata address, as off EC2, the chain gives
+// up within seconds however long S3 requests may take
+func TestCredentialsNoMetadata(t *testing.T) {
+
+	isolateCredentials(t)
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+
+	config := S3Config{
+		Endpoint:         "http://127.0.0.1:1",
+		MetadataEndpoint: stalled.URL,
+		RequestTimeout:   time.Minute,
+		RetryMaxAttempts: 10,
+	}
+	client, err := NewClient("test", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = client.creds.Get()
+	if err == nil {
+		t.Fatal("credentials from nowhere")
+	}
+	if took := time.Since(start); took > 20*time.Second {
+		t.Fatalf("gave up after %v", took)
+	}
+}
@@ -0,0 +1,232 @@
+/*
+ * endpoint.go
+ * Endpoint, addressing, TLS and request signing for S3-compatible servers
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
+)
+
+
+// Addressing styles, see S3Config.Addressing.
+const (
+	addressingAuto    = "auto"
+	addressingPath    = "path"
+	addressingVirtual = "virtual"
+)
+
+// Signature versions, see S3Config.SignatureVersion.
+const (
+	signatureV4 = "v4"
+	signatureV2 = "v2"
+)
+
+
+// usePathStyle reports whether bucket names go in the URL path rather than
+// the host name. Auto picks path-style for custom endpoints, which is what
+// MinIO, Ceph RGW and SeaweedFS expect out of the box.
+func usePathStyle(config S3Config) (bool, error) {
+
+	switch config.Addressing {
+	case "", addressingAuto:
+		return config.Endpoint != "", nil
+	case addressingPath:
+		return true, nil
+	case addressingVirtual:
+		return false, nil
+	}
+	return false, fmt.Errorf("addressing must be %s, %s or %s", addressingAuto, addressingPath, addressingVirtual)
+}
+
+
+// newHTTPClient returns the HTTP client for the S3 client, with the TLS
+// settings and the request_timeout for servers that accept a connection or
+// a request and then never answer. Stalled bodies and the total_timeout of
+// a call are up to AWSStore.
+func newHTTPClient(config S3Config) (*http.Client, error) {
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if timeout := requestTimeout(config); timeout > 0 {
+		dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = timeout
+		transport.ResponseHeaderTimeout = timeout
+	}
+
+	if config.CABundle == "" && !config.InsecureTLS {
+		return &http.Client{Transport: transport}, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureTLS,
+	}
+
+	if config.CABundle != "" {
+
+		pem, err := ioutil.ReadFile(config.CABundle)
+		if err != nil {
+			return nil, err
+		}
+
+		// the bundle adds to the system roots rather than replacing them
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", config.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport}, nil
+}
+
+
+// setSignatureVersion switches the client to the configured signature
+// version. v4 is the SDK default and needs nothing.
+func setSignatureVersion(svc *aws_s3.S3, config S3Config, bucket string, pathStyle bool) error {
+
+	switch config.SignatureVersion {
+	case "", signatureV4:
+		return nil
+	case signatureV2:
+		svc.Handlers.Sign.Swap(v4.SignRequestHandler.Name, request.NamedHandler{
+			Name: "s3fs.SignV2RequestHandler",
+			Fn: func(r *request.Request) {
+				signV2(r, bucket, pathStyle)
+			},
+		})
+		return nil
+	}
+	return fmt.Errorf("signature_version must be %s or %s", signatureV4, signatureV2)
+}
+
+
+// sub-resources that are part of the v2 string to sign
+var v2SubResources = map[string]bool{
+	"acl": true, "delete": true, "lifecycle": true, "location": true,
+	"logging": true, "notification": true, "partNumber": true, "policy": true,
+	"requestPayment": true, "tagging": true, "torrent": true, "uploadId": true,
+	"uploads": true, "versionId": true, "versioning": true, "versions": true,
+	"website": true,
+	"response-cache-control": true, "response-content-disposition": true,
+	"response-content-encoding": true, "response-content-language": true,
+	"response-content-type": true, "response-expires": true,
+}
+
+
+// signV2 signs a request with the legacy S3 signature version 2 that some
+// older S3-compatible servers still require.
+func signV2(r *request.Request, bucket string, pathStyle bool) {
+
+	creds, err := r.Config.Credentials.Get()
+	if err != nil {
+		r.Error = err
+		return
+	}
+
+	// anonymous
+	if creds.AccessKeyID == "" {
+		return
+	}
+
+	req := r.HTTPRequest
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	// x-amz-* headers, sorted, lowercase
+	var amz []string
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			amz = append(amz, lower+":"+strings.Join(req.Header.Values(name), ","))
+		}
+	}
+	sort.Strings(amz)
+
+	// /bucket/key plus sub-resources
+	resource := req.URL.EscapedPath()
+	if !pathStyle {
+		resource = "/" + bucket + resource
+	}
+	query := req.URL.Query()
+	var subs []string
+	for name := range query {
+		if !v2SubResources[name] {
+			continue
+		}
+		if value := query.Get(name); value != "" {
+			subs = append(subs, name+"="+value)
+		} else {
+			subs = append(subs, name)
+		}
+	}
+	sort.Strings(subs)
+	if len(subs) > 0 {
+		resource += "?" + strings.Join(subs, "&")
+	}
+
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	b.WriteString(req.Header.Get("Content-MD5") + "\n")
+	b.WriteString(req.Header.Get("Content-Type") + "\n")
+	b.WriteString(req.Header.Get("Date") + "\n")
+	for _, header := range amz {
+		b.WriteString(header + "\n")
+	}
+	b.WriteString(resource)
+
+	mac := hmac.New(sha1.New, []byte(creds.SecretAccessKey))
+	mac.Write([]byte(b.String()))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req.Header.Set("Authorization", "AWS "+creds.AccessKeyID+":"+signature)
+}
+
+
+// endpointConfig applies the endpoint and addressing settings to the
+// session config.
+func endpointConfig(awsConfig *aws.Config, config S3Config) error {
+
+	pathStyle, err := usePathStyle(config)
+	if err != nil {
+		return err
+	}
+
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	awsConfig.S3ForcePathStyle = aws.Bool(pathStyle)
+
+	return nil
+}
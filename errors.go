@@ -0,0 +1,190 @@
+/*
+ * errors.go
+ * Translation of S3 and local errors into FUSE error codes
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// S3 error codes and the errno each one is reported as. Codes not listed
+// fall back on the HTTP status, see statusErrc.
+var awsErrc = map[string]int{
+
+	// missing
+	aws_s3.ErrCodeNoSuchKey:    fuse.ENOENT,
+	aws_s3.ErrCodeNoSuchBucket: fuse.ENOENT,
+	aws_s3.ErrCodeNoSuchUpload: fuse.ENOENT,
+	"NotFound":                 fuse.ENOENT,
+
+	// permissions and credentials
+	"AccessDenied":          fuse.EACCES,
+	"AllAccessDisabled":     fuse.EACCES,
+	"AccountProblem":        fuse.EACCES,
+	"InvalidAccessKeyId":    fuse.EACCES,
+	"SignatureDoesNotMatch": fuse.EACCES,
+	"ExpiredToken":          fuse.EACCES,
+	"InvalidToken":          fuse.EACCES,
+	"NoCredentialProviders": fuse.EACCES,
+	"InvalidObjectState":    fuse.EACCES, // archived in Glacier
+
+	// throttling, try again
+	"SlowDown":             fuse.EAGAIN,
+	"Throttling":           fuse.EAGAIN,
+	"ThrottlingException":  fuse.EAGAIN,
+	"RequestLimitExceeded": fuse.EAGAIN,
+	"TooManyRequests":      fuse.EAGAIN,
+	"ServiceUnavailable":   fuse.EAGAIN,
+	"OperationAborted":     fuse.EAGAIN,
+
+	// bad requests
+	"InvalidRange":      fuse.EINVAL,
+	"InvalidArgument":   fuse.EINVAL,
+	"InvalidRequest":    fuse.EINVAL,
+	"InvalidObjectName": fuse.EINVAL,
+	"KeyTooLongError":   fuse.ENAMETOOLONG,
+
+	// size limits
+	"EntityTooLarge":           fuse.EFBIG,
+	"EntityTooSmall":           fuse.EINVAL,
+	"MaxMessageLengthExceeded": fuse.EFBIG,
+	"QuotaExceeded":            fuse.ENOSPC,
+
+	// conditional requests
+	"PreconditionFailed": fuse.EEXIST,
+	"BucketNotEmpty":     fuse.ENOTEMPTY,
+
+	// time
+	"RequestTimeout":               fuse.ETIMEDOUT,
+	request.ErrCodeResponseTimeout: fuse.ETIMEDOUT,
+	"RequestTimeTooSkewed":         fuse.EACCES,
+	request.CanceledErrorCode:      fuse.EINTR,
+
+	"NotImplemented": fuse.ENOSYS,
+}
+
+
+// fuseErrc returns the negative errno that a failed operation reports to the
+// kernel; anything unknown is -EIO.
+func fuseErrc(err error) int {
+
+	if err == nil {
+		return 0
+	}
+
+	switch {
+	case errors.Is(err, ErrStagingFull):
+		return -fuse.ENOSPC
+	case errors.Is(err, ErrNotSequential):
+		// a random write that found no staging space
+		return -fuse.ENOSPC
+	case errors.Is(err, os.ErrNotExist):
+		return -fuse.ENOENT
+	case errors.Is(err, os.ErrPermission):
+		return -fuse.EACCES
+	case errors.Is(err, context.DeadlineExceeded):
+		return -fuse.ETIMEDOUT
+	case errors.Is(err, context.Canceled):
+		return -fuse.EINTR
+	case errors.Is(err, syscall.ENOSPC):
+		return -fuse.ENOSPC
+	}
+
+	// an errno passed along as it is
+	var ferr fuse.Error
+	if errors.As(err, &ferr) {
+		return -int(ferr)
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+
+		// total_timeout ran out, rather than an interrupted call
+		if aerr.Code() == request.CanceledErrorCode && errors.Is(aerr.OrigErr(), context.DeadlineExceeded) {
+			return -fuse.ETIMEDOUT
+		}
+		if errc, found := awsErrc[aerr.Code()]; found {
+			return -errc
+		}
+
+		// transport failures are wrapped, look at the cause
+		if aerr.OrigErr() != nil && aerr.OrigErr() != err {
+			if errc := fuseErrc(aerr.OrigErr()); errc != -fuse.EIO {
+				return errc
+			}
+		}
+
+		if rerr, ok := aerr.(awserr.RequestFailure); ok {
+			return statusErrc(rerr.StatusCode())
+		}
+		return -fuse.EIO
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return -fuse.ETIMEDOUT
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return -fuse.ECONNREFUSED
+	case errors.Is(err, syscall.ECONNRESET):
+		return -fuse.ECONNRESET
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return -fuse.EHOSTUNREACH
+	case errors.Is(err, syscall.ENETUNREACH):
+		return -fuse.ENETUNREACH
+	}
+	var derr *net.DNSError
+	if errors.As(err, &derr) {
+		return -fuse.EHOSTUNREACH
+	}
+
+	return -fuse.EIO
+}
+
+
+// statusErrc maps the HTTP status of an error response without a known code,
+// as HEAD responses have no body.
+func statusErrc(status int) int {
+
+	switch {
+	case status == 404:
+		return -fuse.ENOENT
+	case status == 401 || status == 403:
+		return -fuse.EACCES
+	case status == 409:
+		return -fuse.EBUSY
+	case status == 412:
+		return -fuse.EEXIST
+	case status == 413:
+		return -fuse.EFBIG
+	case status == 416:
+		return -fuse.EINVAL
+	case status == 408:
+		return -fuse.ETIMEDOUT
+	case status == 429 || status == 503:
+		return -fuse.EAGAIN
+	case status == 400:
+		return -fuse.EINVAL
+	}
+	return -fuse.EIO
+}
@@ -0,0 +1,685 @@
+/*
+ * fakes3_test.go
+ * In-process fake S3 server on top of MemStore, for the tests
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+
+// FakeS3 serves one bucket of a MemStore over the S3 REST API, path-style,
+// as much of it as AWSStore uses: ListObjectsV2 with delimiters and
+// pagination, HEAD, ranged GET, PUT with metadata and If-None-Match,
+// CopyObject, DeleteObject(s) and multipart uploads with UploadPartCopy.
+// Requests are not authenticated.
+//
+// Fail makes the next requests fail and Cut breaks off the next bodies of
+// GET, for testing retries.
+type FakeS3 struct {
+
+	store  *MemStore
+	bucket string
+
+	lock     sync.Mutex
+	failures []fakeFailure
+	cuts     []time.Duration
+	requests int
+
+	listener net.Listener
+	server   *http.Server
+}
+
+
+type fakeFailure struct {
+
+	code   string
+	status int
+	stall  time.Duration
+}
+
+
+// StartFakeS3 serves bucket from store on a loopback port, see URL.
+func StartFakeS3(store *MemStore, bucket string) (*FakeS3, error) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	fake := &FakeS3{store: store, bucket: bucket, listener: listener}
+	fake.server = &http.Server{Handler: fake}
+	go fake.server.Serve(listener)
+	return fake, nil
+}
+
+
+// URL is the endpoint to give NewClient.
+func (self *FakeS3) URL() string {
+
+	return "http://" + self.listener.Addr().String()
+}
+
+
+func (self *FakeS3) Close() error {
+
+	return self.server.Close()
+}
+
+
+// Fail answers the next n requests with the error code and status; with a
+// stall, the answer only comes after it.
+func (self *FakeS3) Fail(n int, code string, status int, stall time.Duration) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i := 0; i < n; i++ {
+		self.failures = append(self.failures, fakeFailure{code: code, status: status, stall: stall})
+	}
+}
+
+
+// Cut sends only half the body of the next n object GETs, then waits for
+// stall and drops the connection.
+func (self *FakeS3) Cut(n int, stall time.Duration) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i := 0; i < n; i++ {
+		self.cuts = append(self.cuts, stall)
+	}
+}
+
+
+// Requests returns the number of requests served, failed ones included.
+func (self *FakeS3) Requests() int {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.requests
+}
+
+
+func (self *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	self.lock.Lock()
+	self.requests++
+	var failure *fakeFailure
+	if len(self.failures) > 0 {
+		failure = &self.failures[0]
+		self.failures = self.failures[1:]
+	}
+	self.lock.Unlock()
+
+	// read the body either way, the client may be waiting to send it
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+
+	if failure != nil {
+		if failure.stall > 0 {
+			select {
+			case <-time.After(failure.stall):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		self.fail(w, r, storeError(failure.code, failure.status, "injected failure"))
+		return
+	}
+
+	bucket, key := r.URL.Path, ""
+	if i := strings.Index(bucket[1:], "/"); i >= 0 {
+		bucket, key = bucket[1:i+1], bucket[i+2:]
+	} else {
+		bucket = bucket[1:]
+	}
+	if bucket != self.bucket {
+		self.fail(w, r, storeError("NoSuchBucket", 404, bucket))
+		return
+	}
+
+	query := r.URL.Query()
+	_, uploads := query["uploads"]
+	_, multiDelete := query["delete"]
+	uploadId := query.Get("uploadId")
+	copySource := r.Header.Get("X-Amz-Copy-Source")
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		err = self.list(w, query)
+	case key == "" && r.Method == http.MethodPost && multiDelete:
+		err = self.deleteObjects(w, body)
+	case key == "":
+		err = storeError("MethodNotAllowed", 405, r.Method)
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		err = self.get(w, r, key)
+	case r.Method == http.MethodPut && uploadId != "" && copySource != "":
+		err = self.uploadPartCopy(w, r, key, uploadId, copySource)
+	case r.Method == http.MethodPut && uploadId != "":
+		err = self.uploadPart(w, r, key, uploadId, body)
+	case r.Method == http.MethodPut && copySource != "":
+		err = self.copyObject(w, r, key, copySource)
+	case r.Method == http.MethodPut:
+		err = self.put(w, r, key, body)
+	case r.Method == http.MethodPost && uploads:
+		err = self.createMultipart(w, r, key)
+	case r.Method == http.MethodPost && uploadId != "":
+		err = self.completeMultipart(w, key, uploadId, body)
+	case r.Method == http.MethodDelete && uploadId != "":
+		err = self.store.AbortMultipart(key, uploadId)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case r.Method == http.MethodDelete:
+		err = self.store.Delete(key)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		err = storeError("MethodNotAllowed", 405, r.Method)
+	}
+
+	if err != nil {
+		self.fail(w, r, err)
+	}
+}
+
+
+// fail writes an S3 error response; HEAD responses have no body.
+func (self *FakeS3) fail(w http.ResponseWriter, r *http.Request, err error) {
+
+	code, status, message := "InternalError", http.StatusInternalServerError, err.Error()
+	var rerr awserr.RequestFailure
+	if errors.As(err, &rerr) {
+		code, status, message = rerr.Code(), rerr.StatusCode(), rerr.Message()
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
+
+type fakeListResult struct {
+
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []fakeListObject
+	CommonPrefixes        []fakeListPrefix
+}
+
+
+type fakeListObject struct {
+
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+
+type fakeListPrefix struct {
+
+	Prefix string
+}
+
+
+func (self *FakeS3) list(w http.ResponseWriter, query url.Values) error {
+
+	if query.Get("list-type") != "2" {
+		return storeError("NotImplemented", 501, "only ListObjectsV2")
+	}
+
+	max := memListMax
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return storeError("InvalidArgument", 400, "max-keys")
+		}
+		max = n
+	}
+
+	result := fakeListResult{
+		Name:              self.bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		MaxKeys:           max,
+		ContinuationToken: query.Get("continuation-token"),
+	}
+
+	if max > 0 {
+		page, err := self.store.List(result.Prefix, result.Delimiter, result.ContinuationToken, max)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Objects {
+			result.Contents = append(result.Contents, fakeListObject{
+				Key:          obj.Key,
+				LastModified: obj.LastModified.Format("2006-01-02T15:04:05.000Z"),
+				ETag:         `"` + obj.ETag + `"`,
+				Size:         obj.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+		for _, prefix := range page.Prefixes {
+			result.CommonPrefixes = append(result.CommonPrefixes, fakeListPrefix{Prefix: prefix})
+		}
+		result.KeyCount = len(page.Objects) + len(page.Prefixes)
+		result.IsTruncated = page.Next != ""
+		result.NextContinuationToken = page.Next
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	writeXML(w, result)
+	return nil
+}
+
+
+func (self *FakeS3) get(w http.ResponseWriter, r *http.Request, key string) error {
+
+	info, err := self.store.Head(key)
+	if err != nil {
+		if r.Method == http.MethodGet {
+			return storeError("NoSuchKey", 404, key)
+		}
+		return err
+	}
+
+	header := w.Header()
+	for name, value := range info.Metadata {
+		header.Set("X-Amz-Meta-"+name, *value)
+	}
+	setHeader(header, "Content-Type", info.ContentType)
+	setHeader(header, "Cache-Control", info.CacheControl)
+	setHeader(header, "Content-Disposition", info.ContentDisposition)
+	setHeader(header, "Content-Encoding", info.ContentEncoding)
+	setHeader(header, "Content-Language", info.ContentLanguage)
+	header.Set("ETag", `"`+info.ETag+`"`)
+	header.Set("Last-Modified", info.LastModified.Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+
+	if r.Method == http.MethodHead {
+		header.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		return nil
+	}
+
+	off, n, ranged, err := parseRange(r.Header.Get("Range"), info.Size)
+	if err != nil {
+		return err
+	}
+	body, err := self.store.GetRange(key, off, n)
+	if err == io.EOF {
+		// an empty object, which has no range to give
+		header.Set("Content-Length", "0")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	if ranged {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+int64(len(data))-1, info.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	self.lock.Lock()
+	cut := len(self.cuts) > 0
+	var stall time.Duration
+	if cut {
+		stall, self.cuts = self.cuts[0], self.cuts[1:]
+	}
+	self.lock.Unlock()
+	if cut {
+		w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(stall):
+		case <-r.Context().Done():
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	w.Write(data)
+	return nil
+}
+
+
+// parseRange reads a "bytes=first-[last]" Range header; other forms are
+// not used by AWSStore.
+func parseRange(value string, size int64) (off int64, n int64, ranged bool, err error) {
+
+	if value == "" {
+		return 0, -1, false, nil
+	}
+
+	spec := strings.TrimPrefix(value, "bytes=")
+	dash := strings.Index(spec, "-")
+	if spec == value || dash < 0 {
+		return 0, 0, false, storeError("InvalidArgument", 400, value)
+	}
+
+	off, err = strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, false, storeError("InvalidArgument", 400, value)
+	}
+	n = -1
+	if spec[dash+1:] != "" {
+		last, err := strconv.ParseInt(spec[dash+1:], 10, 64)
+		if err != nil || last < off {
+			return 0, 0, false, storeError("InvalidArgument", 400, value)
+		}
+		n = last - off + 1
+	}
+
+	if off >= size {
+		return 0, 0, false, storeError("InvalidRange", 416, value)
+	}
+	return off, n, true, nil
+}
+
+
+func (self *FakeS3) put(w http.ResponseWriter, r *http.Request, key string, body []byte) error {
+
+	opts := putOptions(r)
+	opts.IfNoneMatch = r.Header.Get("If-None-Match") == "*"
+
+	info, err := self.store.Put(key, bytes.NewReader(body), opts)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", `"`+info.ETag+`"`)
+	return nil
+}
+
+
+type fakeCopyResult struct {
+
+	ETag         string
+	LastModified string
+}
+
+
+func (self *FakeS3) copyObject(w http.ResponseWriter, r *http.Request, key string, copySource string) error {
+
+	src, err := self.copySourceKey(copySource)
+	if err != nil {
+		return err
+	}
+
+	var opts *PutOptions
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		replace := putOptions(r)
+		opts = &replace
+	}
+
+	info, err := self.store.Copy(src, key, opts)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CopyObjectResult"`
+		fakeCopyResult
+	}{fakeCopyResult: fakeCopyResult{
+		ETag:         `"` + info.ETag + `"`,
+		LastModified: info.LastModified.Format("2006-01-02T15:04:05.000Z"),
+	}})
+	return nil
+}
+
+
+func (self *FakeS3) createMultipart(w http.ResponseWriter, r *http.Request, key string) error {
+
+	uploadId, err := self.store.CreateMultipart(key, putOptions(r))
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: self.bucket, Key: key, UploadId: uploadId})
+	return nil
+}
+
+
+func (self *FakeS3) uploadPart(w http.ResponseWriter, r *http.Request, key string, uploadId string, body []byte) error {
+
+	n, err := strconv.ParseInt(r.URL.Query().Get("partNumber"), 10, 64)
+	if err != nil {
+		return storeError("InvalidArgument", 400, "partNumber")
+	}
+
+	etag, err := self.store.UploadPart(key, uploadId, n, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag)
+	return nil
+}
+
+
+func (self *FakeS3) uploadPartCopy(w http.ResponseWriter, r *http.Request, key string, uploadId string, copySource string) error {
+
+	n, err := strconv.ParseInt(r.URL.Query().Get("partNumber"), 10, 64)
+	if err != nil {
+		return storeError("InvalidArgument", 400, "partNumber")
+	}
+	src, err := self.copySourceKey(copySource)
+	if err != nil {
+		return err
+	}
+
+	info, err := self.store.Head(src)
+	if err != nil {
+		return storeError("NoSuchKey", 404, src)
+	}
+	off, size, _, err := parseRange(r.Header.Get("X-Amz-Copy-Source-Range"), info.Size)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		size = info.Size - off
+	}
+
+	etag, err := self.store.UploadPartCopy(key, uploadId, n, src, off, off+size)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CopyPartResult"`
+		fakeCopyResult
+	}{fakeCopyResult: fakeCopyResult{
+		ETag:         etag,
+		LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+	}})
+	return nil
+}
+
+
+func (self *FakeS3) completeMultipart(w http.ResponseWriter, key string, uploadId string, body []byte) error {
+
+	var request struct {
+		Parts []struct {
+			PartNumber int64
+			ETag       string
+		} `xml:"Part"`
+	}
+	err := xml.Unmarshal(body, &request)
+	if err != nil {
+		return storeError("MalformedXML", 400, err.Error())
+	}
+
+	parts := make([]Part, len(request.Parts))
+	for i, part := range request.Parts {
+		parts[i] = Part{Number: part.PartNumber, ETag: part.ETag}
+	}
+	info, err := self.store.CompleteMultipart(key, uploadId, parts)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: self.bucket, Key: key, ETag: `"` + info.ETag + `"`})
+	return nil
+}
+
+
+func (self *FakeS3) deleteObjects(w http.ResponseWriter, body []byte) error {
+
+	var request struct {
+		Quiet   bool
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	err := xml.Unmarshal(body, &request)
+	if err != nil {
+		return storeError("MalformedXML", 400, err.Error())
+	}
+
+	keys := make([]string, len(request.Objects))
+	for i, obj := range request.Objects {
+		keys[i] = obj.Key
+	}
+	err = self.store.DeleteKeys(keys)
+	if err != nil {
+		return err
+	}
+
+	type deleted struct {
+		Key string
+	}
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Deleted []deleted `xml:"Deleted"`
+	}{}
+	if !request.Quiet {
+		for _, key := range keys {
+			result.Deleted = append(result.Deleted, deleted{Key: key})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	writeXML(w, result)
+	return nil
+}
+
+
+// copySourceKey reads the key out of an x-amz-copy-source header.
+func (self *FakeS3) copySourceKey(value string) (string, error) {
+
+	source, err := url.PathUnescape(strings.TrimPrefix(value, "/"))
+	if err != nil {
+		return "", storeError("InvalidArgument", 400, value)
+	}
+	if i := strings.Index(source, "?"); i >= 0 {
+		source = source[:i]
+	}
+	if !strings.HasPrefix(source, self.bucket+"/") {
+		return "", storeError("NoSuchBucket", 404, source)
+	}
+	return strings.TrimPrefix(source, self.bucket+"/"), nil
+}
+
+
+// putOptions reads metadata and content headers off a request.
+func putOptions(r *http.Request) PutOptions {
+
+	opts := PutOptions{
+		ContentHeaders: ContentHeaders{
+			ContentType:        r.Header.Get("Content-Type"),
+			CacheControl:       r.Header.Get("Cache-Control"),
+			ContentDisposition: r.Header.Get("Content-Disposition"),
+			ContentEncoding:    r.Header.Get("Content-Encoding"),
+			ContentLanguage:    r.Header.Get("Content-Language"),
+		},
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") && len(values) > 0 {
+			if opts.Metadata == nil {
+				opts.Metadata = make(map[string]*string)
+			}
+			value := values[0]
+			opts.Metadata[strings.TrimPrefix(name, "X-Amz-Meta-")] = &value
+		}
+	}
+	return opts
+}
+
+
+func setHeader(header http.Header, name string, value string) {
+
+	if value != "" {
+		header.Set(name, value)
+	}
+}
+
+
+func writeXML(w io.Writer, v interface{}) {
+
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
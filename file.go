@@ -0,0 +1,124 @@
+/*
+ * file.go
+ * File, an io.ReaderAt view of a single S3 object
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+
+// File represents a file in S3, for reading; writes go through Writer.
+// Read keeps an offset and is not threadsafe; ReadAt does not touch it and
+// may be called concurrently.
+type File struct {
+
+	client *S3
+	name   string
+
+	// state
+	offset int64
+	closed bool
+}
+
+
+// NewFile initializes an File object for the object key name.
+func NewFile(client *S3, name string) *File {
+	return &File{
+		client: client,
+		name:   name,
+		offset: 0,
+		closed: false,
+	}
+}
+
+
+// Close closes the File, rendering it unusable for I/O.
+// It returns an error, if any.
+func (f *File) Close() error {
+	f.closed = true
+	return nil
+}
+
+// Read reads up to len(b) bytes from the File.
+// It returns the number of bytes read and an error, if any.
+// EOF is signaled by a zero count with err set to io.EOF.
+func (f *File) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes from the file starting at byte offset off.
+// It returns the number of bytes read and the error, if any.
+// ReadAt always returns a non-nil error when n < len(b).
+// At end of file, that error is io.EOF.
+//
+// Only the requested window is fetched, with a ranged GET. A body that
+// stalls or breaks off is fetched again from where it stopped.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if f.closed {
+		return 0, errors.New("read after close")
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		body, err := f.client.store.GetRange(f.name, off+int64(n), int64(len(p)-n))
+		if err != nil {
+			return n, err
+		}
+		m, err := readBody(body, p[n:])
+		body.Close()
+		n += m
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		delay, retry := f.client.retry.retryBody(attempt, start, err)
+		if !retry {
+			return n, err
+		}
+		time.Sleep(delay)
+	}
+}
+
+// readBody fills p from body. Unlike io.ReadFull it keeps a body that ends
+// early, io.EOF, apart from a connection that broke off.
+func readBody(body io.Reader, p []byte) (n int, err error) {
+	for n < len(p) && err == nil {
+		var m int
+		m, err = body.Read(p[n:])
+		n += m
+	}
+	if n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+// Size returns the current size of the object.
+func (f *File) Size() (int64, error) {
+	info, err := f.client.store.Head(f.name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
@@ -0,0 +1,11 @@
+module s3fs
+
+go 1.18
+
+require (
+	github.com/aws/aws-sdk-go v1.44.0
+	github.com/winfsp/cgofuse v1.6.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/jmespath/go-jmespath v0.4.0 // indirect
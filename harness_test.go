@@ -0,0 +1,267 @@
+/*
+ * harness_test.go
+ * Drives the S3fs callbacks without mounting
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// Harness calls S3fs the way the kernel would, one callback at a time, and
+// returns errors instead of negative errnos: an errno comes back as
+// fuse.Error. Nothing is mounted, so it runs anywhere, FUSE or not.
+type Harness struct {
+
+	fs *S3fs
+}
+
+
+func NewHarness(client *S3, config S3Config) (*Harness, error) {
+
+	fs, err := NewS3fs(client, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Harness{fs: fs}, nil
+}
+
+
+// harnessChunk is the size of the reads and writes ReadFile and WriteFile
+// issue, as the kernel does with max_write.
+const harnessChunk = 128 << 10
+
+
+func errcError(errc int) error {
+
+	if errc >= 0 {
+		return nil
+	}
+	return fuse.Error(-errc)
+}
+
+
+// isErrno tells whether err is the errno, given as a positive fuse constant.
+func isErrno(err error, errno int) bool {
+
+	var ferr fuse.Error
+	return errors.As(err, &ferr) && int(ferr) == errno
+}
+
+
+func (self *Harness) Create(path string, flags int, mode uint32) (uint64, error) {
+
+	errc, fh := self.fs.Create(path, flags, mode)
+	return fh, errcError(errc)
+}
+
+
+func (self *Harness) Open(path string, flags int) (uint64, error) {
+
+	errc, fh := self.fs.Open(path, flags)
+	return fh, errcError(errc)
+}
+
+
+func (self *Harness) Write(path string, fh uint64, data []byte, off int64) error {
+
+	n := self.fs.Write(path, data, off, fh)
+	if n < 0 {
+		return errcError(n)
+	}
+	if n != len(data) {
+		return fmt.Errorf("%s: short write, %d of %d bytes", path, n, len(data))
+	}
+	return nil
+}
+
+
+func (self *Harness) Read(path string, fh uint64, size int, off int64) ([]byte, error) {
+
+	buf := make([]byte, size)
+	n := self.fs.Read(path, buf, off, fh)
+	if n < 0 {
+		return nil, errcError(n)
+	}
+	return buf[:n], nil
+}
+
+
+func (self *Harness) Fsync(path string, fh uint64) error {
+
+	return errcError(self.fs.Fsync(path, false, fh))
+}
+
+
+// Close is close(2): Flush, then Release as the last reference goes.
+func (self *Harness) Close(path string, fh uint64) error {
+
+	err := errcError(self.fs.Flush(path, fh))
+	if rerr := errcError(self.fs.Release(path, fh)); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+
+// WriteFile creates or replaces path with data.
+func (self *Harness) WriteFile(path string, data []byte) error {
+
+	fh, err := self.Create(path, fuse.O_WRONLY|fuse.O_CREAT|fuse.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for off := 0; off < len(data); off += harnessChunk {
+		end := off + harnessChunk
+		if end > len(data) {
+			end = len(data)
+		}
+		err = self.Write(path, fh, data[off:end], int64(off))
+		if err != nil {
+			self.Close(path, fh)
+			return err
+		}
+	}
+	return self.Close(path, fh)
+}
+
+
+func (self *Harness) ReadFile(path string) ([]byte, error) {
+
+	fh, err := self.Open(path, fuse.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	for {
+		chunk, err := self.Read(path, fh, harnessChunk, int64(len(data)))
+		if err != nil {
+			self.Close(path, fh)
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if len(chunk) < harnessChunk {
+			return data, self.Close(path, fh)
+		}
+	}
+}
+
+
+func (self *Harness) Stat(path string) (*fuse.Stat_t, error) {
+
+	stat := &fuse.Stat_t{}
+	errc := self.fs.Getattr(path, stat, ^uint64(0))
+	if errc != 0 {
+		return nil, errcError(errc)
+	}
+	return stat, nil
+}
+
+
+// DirEntry is an entry ReadDir returned, with the stat Readdir gave along.
+type DirEntry struct {
+
+	Name string
+	Stat *fuse.Stat_t
+}
+
+
+// ReadDir lists path, without "." and "..", sorted by name.
+func (self *Harness) ReadDir(path string) ([]DirEntry, error) {
+
+	errc, fh := self.fs.Opendir(path)
+	if errc != 0 {
+		return nil, errcError(errc)
+	}
+	defer self.fs.Releasedir(path, fh)
+
+	var entries []DirEntry
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if name != "." && name != ".." {
+			entries = append(entries, DirEntry{Name: name, Stat: stat})
+		}
+		return true
+	}
+	errc = self.fs.Readdir(path, fill, 0, fh)
+	if errc != 0 {
+		return nil, errcError(errc)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+
+func (self *Harness) Mkdir(path string, mode uint32) error {
+
+	return errcError(self.fs.Mkdir(path, mode))
+}
+
+
+func (self *Harness) Rmdir(path string) error {
+
+	return errcError(self.fs.Rmdir(path))
+}
+
+
+func (self *Harness) Unlink(path string) error {
+
+	return errcError(self.fs.Unlink(path))
+}
+
+
+func (self *Harness) Rename(oldpath string, newpath string, flags uint32) error {
+
+	return errcError(self.fs.Rename3(oldpath, newpath, flags))
+}
+
+
+// Truncate is truncate(2), or ftruncate(2) with a handle from Open.
+func (self *Harness) Truncate(path string, size int64, fh uint64) error {
+
+	return errcError(self.fs.Truncate(path, size, fh))
+}
+
+
+func (self *Harness) Chmod(path string, mode uint32) error {
+
+	return errcError(self.fs.Chmod(path, mode))
+}
+
+
+func (self *Harness) Chown(path string, uid uint32, gid uint32) error {
+
+	return errcError(self.fs.Chown(path, uid, gid))
+}
+
+
+// Utimens sets the modification time; atime is not kept.
+func (self *Harness) Utimens(path string, mtime time.Time) error {
+
+	tmsp := []fuse.Timespec{fuse.NewTimespec(mtime), fuse.NewTimespec(mtime)}
+	return errcError(self.fs.Utimens(path, tmsp))
+}
+
+
+// Destroy waits for background uploads, as at unmount.
+func (self *Harness) Destroy() {
+
+	self.fs.Destroy()
+}
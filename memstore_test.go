@@ -0,0 +1,391 @@
+/*
+ * memstore_test.go
+ * ObjectStore in memory, with the semantics of S3
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// MemStore keeps a bucket in memory, for running the file system without a
+// server. It follows S3 where the file system depends on it: listings in
+// key order with common prefixes, ETags that are MD5 sums, 5 MB minimum
+// parts, conditional PUT, and the same error codes.
+type MemStore struct {
+
+	lock    sync.Mutex
+	objects map[string]*memObject
+	uploads map[string]*memUpload
+	lastId  int
+}
+
+
+type memObject struct {
+
+	data []byte
+	info ObjectInfo
+}
+
+
+type memUpload struct {
+
+	key   string
+	opts  PutOptions
+	parts map[int64][]byte
+}
+
+
+// S3 limits that MemStore enforces.
+const (
+	memListMax     = 1000
+	memMinPartSize = 5 << 20
+)
+
+
+func NewMemStore() *MemStore {
+
+	return &MemStore{
+		objects: make(map[string]*memObject),
+		uploads: make(map[string]*memUpload),
+	}
+}
+
+
+// List tokens name the last key or prefix returned, tagged k: or p: so
+// that a marker key ending in the delimiter is not taken for a prefix.
+func (self *MemStore) List(prefix string, delimiter string, token string, max int) (ListPage, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if max <= 0 || max > memListMax {
+		max = memListMax
+	}
+
+	keys := make([]string, 0, len(self.objects))
+	for key := range self.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	after, skip := "", ""
+	switch {
+	case strings.HasPrefix(token, "k:"):
+		after = token[2:]
+	case strings.HasPrefix(token, "p:"):
+		after, skip = token[2:], token[2:]
+	case token != "":
+		return ListPage{}, storeError("InvalidArgument", 400, "invalid continuation token")
+	}
+
+	page := ListPage{}
+	count := 0
+	for _, key := range keys {
+		if key <= after || (skip != "" && strings.HasPrefix(key, skip)) {
+			continue
+		}
+		if count == max {
+			page.Next = token
+			break
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				page.Prefixes = append(page.Prefixes, common)
+				token, skip = "p:"+common, common
+				count++
+				continue
+			}
+		}
+
+		obj := self.objects[key]
+		page.Objects = append(page.Objects, ObjectInfo{
+			Key:          key,
+			Size:         obj.info.Size,
+			ETag:         obj.info.ETag,
+			LastModified: obj.info.LastModified,
+		})
+		token = "k:" + key
+		count++
+	}
+	return page, nil
+}
+
+
+func (self *MemStore) Head(key string) (ObjectInfo, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	obj, found := self.objects[key]
+	if !found {
+		// HEAD responses have no body, S3 sends no code
+		return ObjectInfo{Key: key}, storeError("NotFound", 404, key)
+	}
+	info := obj.info
+	info.Metadata = copyMetadata(obj.info.Metadata)
+	return info, nil
+}
+
+
+func (self *MemStore) GetRange(key string, off int64, n int64) (io.ReadCloser, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	obj, found := self.objects[key]
+	if !found {
+		return nil, storeError("NoSuchKey", 404, key)
+	}
+	size := int64(len(obj.data))
+	if off >= size {
+		return nil, io.EOF
+	}
+	end := size
+	if n >= 0 && off+n < size {
+		end = off + n
+	}
+	// objects are replaced, never changed, so the slice stays valid
+	return ioutil.NopCloser(bytes.NewReader(obj.data[off:end])), nil
+}
+
+
+func (self *MemStore) Put(key string, body io.ReadSeeker, opts PutOptions) (ObjectInfo, error) {
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return ObjectInfo{Key: key}, err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, found := self.objects[key]; found && opts.IfNoneMatch {
+		return ObjectInfo{Key: key}, storeError("PreconditionFailed", 412, key)
+	}
+	sum := md5.Sum(data)
+	return self.store(key, data, hex.EncodeToString(sum[:]), opts), nil
+}
+
+
+func (self *MemStore) Copy(src string, dst string, opts *PutOptions) (ObjectInfo, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	obj, found := self.objects[src]
+	if !found {
+		return ObjectInfo{Key: dst}, storeError("NoSuchKey", 404, src)
+	}
+	if int64(len(obj.data)) > maxCopyObjectSize {
+		return ObjectInfo{Key: dst}, storeError("InvalidRequest", 400, "copy source larger than 5 GB")
+	}
+
+	keep := PutOptions{Metadata: obj.info.Metadata, ContentHeaders: obj.info.ContentHeaders}
+	if opts == nil {
+		opts = &keep
+	}
+	return self.store(dst, obj.data, obj.info.ETag, *opts), nil
+}
+
+
+func (self *MemStore) Delete(key string) error {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// like S3, deleting nothing succeeds
+	delete(self.objects, key)
+	return nil
+}
+
+
+func (self *MemStore) DeleteKeys(keys []string) error {
+
+	if len(keys) > 1000 {
+		return storeError("MalformedXML", 400, "more than 1000 keys")
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for _, key := range keys {
+		delete(self.objects, key)
+	}
+	return nil
+}
+
+
+func (self *MemStore) CreateMultipart(key string, opts PutOptions) (string, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.lastId++
+	id := fmt.Sprintf("mem-%d", self.lastId)
+	opts.Metadata = copyMetadata(opts.Metadata)
+	self.uploads[id] = &memUpload{key: key, opts: opts, parts: make(map[int64][]byte)}
+	return id, nil
+}
+
+
+func (self *MemStore) UploadPart(key string, uploadId string, n int64, body io.ReadSeeker) (string, error) {
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return self.putPart(key, uploadId, n, data)
+}
+
+
+func (self *MemStore) UploadPartCopy(key string, uploadId string, n int64, src string, off int64, end int64) (string, error) {
+
+	self.lock.Lock()
+	obj, found := self.objects[src]
+	self.lock.Unlock()
+
+	if !found {
+		return "", storeError("NoSuchKey", 404, src)
+	}
+	if off < 0 || off >= end || end > int64(len(obj.data)) {
+		return "", storeError("InvalidRange", 416, fmt.Sprintf("bytes=%d-%d", off, end-1))
+	}
+	return self.putPart(key, uploadId, n, obj.data[off:end])
+}
+
+
+func (self *MemStore) putPart(key string, uploadId string, n int64, data []byte) (string, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	upload, found := self.uploads[uploadId]
+	if !found || upload.key != key {
+		return "", storeError("NoSuchUpload", 404, uploadId)
+	}
+	if n < 1 || n > 10000 {
+		return "", storeError("InvalidArgument", 400, fmt.Sprintf("part number %d", n))
+	}
+
+	upload.parts[n] = data
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`, nil
+}
+
+
+// CompleteMultipart checks the parts like S3: in order, uploaded, with
+// matching ETags, and all but the last at least 5 MB.
+func (self *MemStore) CompleteMultipart(key string, uploadId string, parts []Part) (ObjectInfo, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	upload, found := self.uploads[uploadId]
+	if !found || upload.key != key {
+		return ObjectInfo{Key: key}, storeError("NoSuchUpload", 404, uploadId)
+	}
+	if len(parts) == 0 {
+		return ObjectInfo{Key: key}, storeError("MalformedXML", 400, "no parts")
+	}
+
+	var data []byte
+	sums := md5.New()
+	for i, part := range parts {
+		if i > 0 && part.Number <= parts[i-1].Number {
+			return ObjectInfo{Key: key}, storeError("InvalidPartOrder", 400, fmt.Sprintf("part %d", part.Number))
+		}
+		chunk, found := upload.parts[part.Number]
+		sum := md5.Sum(chunk)
+		if !found || strings.Trim(part.ETag, `"`) != hex.EncodeToString(sum[:]) {
+			return ObjectInfo{Key: key}, storeError("InvalidPart", 400, fmt.Sprintf("part %d", part.Number))
+		}
+		if i < len(parts)-1 && len(chunk) < memMinPartSize {
+			return ObjectInfo{Key: key}, storeError("EntityTooSmall", 400, fmt.Sprintf("part %d", part.Number))
+		}
+		data = append(data, chunk...)
+		sums.Write(sum[:])
+	}
+
+	delete(self.uploads, uploadId)
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), len(parts))
+	return self.store(key, data, etag, upload.opts), nil
+}
+
+
+func (self *MemStore) AbortMultipart(key string, uploadId string) error {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, found := self.uploads[uploadId]; !found {
+		return storeError("NoSuchUpload", 404, uploadId)
+	}
+	delete(self.uploads, uploadId)
+	return nil
+}
+
+
+// Uploads returns the number of multipart uploads neither completed nor
+// aborted, which should be 0 once the file system is idle.
+func (self *MemStore) Uploads() int {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return len(self.uploads)
+}
+
+
+// store sets key. Called with the lock held.
+func (self *MemStore) store(key string, data []byte, etag string, opts PutOptions) ObjectInfo {
+
+	info := ObjectInfo{
+		Key:            key,
+		Size:           int64(len(data)),
+		ETag:           etag,
+		LastModified:   time.Now().UTC(),
+		Metadata:       copyMetadata(opts.Metadata),
+		ContentHeaders: opts.ContentHeaders,
+	}
+	self.objects[key] = &memObject{data: data, info: info}
+
+	info.Metadata = nil
+	return info
+}
+
+
+func copyMetadata(metadata map[string]*string) map[string]*string {
+
+	if metadata == nil {
+		return nil
+	}
+	out := make(map[string]*string, len(metadata))
+	for name, value := range metadata {
+		v := *value
+		out[name] = &v
+	}
+	return out
+}
@@ -0,0 +1,180 @@
+/*
+ * meta.go
+ * File attributes kept in x-amz-meta-* object metadata
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// ObjectMeta holds the attributes stored in object metadata, in the format
+// of the C s3fs-fuse so that both can share a bucket: x-amz-meta-mode, -uid
+// and -gid as decimal numbers, x-amz-meta-mtime as seconds since the epoch.
+// Attributes that are not stored are nil.
+type ObjectMeta struct {
+
+	Mode  *uint32
+	Uid   *uint32
+	Gid   *uint32
+	Mtime *time.Time
+}
+
+
+// metadata names, as the SDK returns them without the x-amz-meta- prefix
+const (
+	metaMode  = "Mode"
+	metaUid   = "Uid"
+	metaGid   = "Gid"
+	metaMtime = "Mtime"
+)
+
+
+// parseMeta reads the attributes out of HeadObject metadata, skipping values
+// that do not parse.
+func parseMeta(metadata map[string]*string) ObjectMeta {
+
+	meta := ObjectMeta{}
+
+	for name, value := range metadata {
+		v := strings.TrimSpace(aws.StringValue(value))
+
+		switch {
+		case strings.EqualFold(name, metaMode):
+			meta.Mode = parseMetaId(v)
+		case strings.EqualFold(name, metaUid):
+			meta.Uid = parseMetaId(v)
+		case strings.EqualFold(name, metaGid):
+			meta.Gid = parseMetaId(v)
+		case strings.EqualFold(name, metaMtime):
+			// s3fs-fuse writes whole seconds, allow a fraction as well
+			secs, err := strconv.ParseFloat(v, 64)
+			if err == nil {
+				t := time.Unix(0, int64(secs*1e9))
+				meta.Mtime = &t
+			}
+		}
+	}
+
+	return meta
+}
+
+
+func parseMetaId(value string) *uint32 {
+
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil
+	}
+	id := uint32(n)
+	return &id
+}
+
+
+// headers merges the attributes into the object's other metadata, which is
+// kept as it is.
+func (self ObjectMeta) headers(metadata map[string]*string) map[string]*string {
+
+	out := make(map[string]*string)
+	for name, value := range metadata {
+		switch {
+		case strings.EqualFold(name, metaMode), strings.EqualFold(name, metaUid),
+			strings.EqualFold(name, metaGid), strings.EqualFold(name, metaMtime):
+			continue
+		}
+		out[strings.ToLower(name)] = value
+	}
+
+	if self.Mode != nil {
+		out["mode"] = aws.String(strconv.FormatUint(uint64(*self.Mode), 10))
+	}
+	if self.Uid != nil {
+		out["uid"] = aws.String(strconv.FormatUint(uint64(*self.Uid), 10))
+	}
+	if self.Gid != nil {
+		out["gid"] = aws.String(strconv.FormatUint(uint64(*self.Gid), 10))
+	}
+	if self.Mtime != nil {
+		out["mtime"] = aws.String(formatMtime(*self.Mtime))
+	}
+	return out
+}
+
+
+// formatMtime writes whole seconds when it can, which s3fs-fuse expects.
+func formatMtime(t time.Time) string {
+
+	if t.Nanosecond() == 0 {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 9, 64)
+}
+
+
+// uploadMeta is what a rewritten object carries over: everything but mtime,
+// which the new LastModified replaces.
+func (self ObjectMeta) uploadMeta() map[string]*string {
+
+	meta := self
+	meta.Mtime = nil
+	headers := meta.headers(nil)
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
+
+// SetMeta stores the attributes of fpath by copying the object onto itself
+// with new metadata, see copyObject. A directory without a marker object
+// gets one.
+func (self *S3) SetMeta(fpath string, isDir bool, meta ObjectMeta) (S3FileObject, error) {
+
+	obj := S3FileObject{Name: path.Base(fpath), IsDir: isDir}
+
+	key := self.key(fpath)
+	if isDir {
+		key += "/"
+	}
+
+	head, err := self.store.Head(key)
+	if err != nil && isDir && fuseErrc(err) == -fuse.ENOENT {
+		info, err := self.store.Put(key, bytes.NewReader(nil), PutOptions{Metadata: meta.headers(nil)})
+		if err != nil {
+			return obj, err
+		}
+		obj.ETag = info.ETag
+		obj.LastModified = info.LastModified
+		return obj, nil
+	}
+	if err != nil {
+		return obj, err
+	}
+
+	etag, mtime, err := self.copyObject(key, key, head.Size, &head, meta.headers(head.Metadata))
+	if err != nil {
+		return obj, err
+	}
+
+	obj.Size = int(head.Size)
+	obj.ContentType = head.ContentType
+	obj.ETag = etag
+	obj.LastModified = mtime
+	return obj, nil
+}
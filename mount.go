@@ -0,0 +1,109 @@
+/*
+ * mount.go
+ * FUSE mount options for each platform
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+
+// maxRead is the largest read the kernel sends, the FUSE 2 limit on Linux.
+const maxRead = 128 << 10
+
+// MountOptions returns the -o arguments for host.Mount: the defaults of the
+// platform, then the options of the config. An option replaces the default
+// of the same name, with or without "no": atime overrides noatime.
+func MountOptions(config S3Config) []string {
+
+	opts := mountDefaults(config, runtime.GOOS)
+	for _, opt := range config.Options {
+		name := optionName(opt)
+		kept := opts[:0]
+		for _, o := range opts {
+			if optionName(o) != name {
+				kept = append(kept, o)
+			}
+		}
+		opts = append(kept, opt)
+	}
+
+	args := make([]string, 0, 2*len(opts))
+	for _, opt := range opts {
+		args = append(args, "-o", opt)
+	}
+	return args
+}
+
+
+func mountDefaults(config S3Config, goos string) []string {
+
+	source := "s3fs:" + config.Bucket
+	if config.Prefix != "" {
+		source += "/" + config.Prefix
+	}
+	// commas would split the option
+	source = strings.ReplaceAll(source, ",", "_")
+
+	switch goos {
+	case "windows":
+		return []string{"ExactFileSystemName=NTFS", "volname=S3"}
+	case "darwin":
+		return []string{"fsname=" + source, "volname=" + config.Bucket}
+	case "linux":
+		opts := []string{
+			"fsname=" + source,
+			"subtype=s3fs",
+			"default_permissions",
+			"noatime",
+			"max_read=" + strconv.Itoa(maxRead),
+		}
+		// other users see the mount, where fusermount lets them
+		if os.Geteuid() == 0 || userAllowOther("/etc/fuse.conf") {
+			opts = append(opts, "allow_other")
+		}
+		return opts
+	}
+	return []string{"fsname=" + source, "default_permissions"}
+}
+
+
+// optionName is the name of a mount option, without its value and "no".
+func optionName(opt string) string {
+
+	name := strings.SplitN(opt, "=", 2)[0]
+	return strings.TrimPrefix(name, "no")
+}
+
+
+// userAllowOther tells whether fuse.conf lets users other than root mount
+// with allow_other.
+func userAllowOther(path string) bool {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "user_allow_other" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,296 @@
+/*
+ * nodes.go
+ * Node cache and open file handles, shared by concurrent FUSE callbacks
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// Node is the cached state of one path, shared by every handle open on it.
+// IsDir is fixed; the rest is guarded by lock. Path changes on rename.
+type Node struct {
+
+	IsDir bool
+
+	lock        sync.Mutex
+	Path        string
+	Size        int
+	Mtime       time.Time
+	ETag        string
+	ContentType string
+	writers     int // handles writing or uploading; their size wins over listings
+
+	// attributes from object metadata, known once the object was read with
+	// HeadObject; metaDirty ones wait for the open writers to finish
+	Meta      ObjectMeta
+	headed    bool
+	metaDirty bool
+
+	// background upload with async_writes
+	flushing chan struct{}
+	flushErr error
+
+	// removed while open; its handles write nowhere
+	unlinked bool
+}
+
+
+// fileHandle is one open() of a file, with a read-ahead and a write buffer
+// of its own, so openers do not move each other's read position or mix
+// their unfinished writes. Writes become visible to other handles when they
+// are stored, on Flush, Fsync or Release.
+type fileHandle struct {
+
+	node  *Node
+	flags int
+
+	lock   sync.Mutex
+	fp     *File
+	ra     io.ReaderAt
+	writer *Writer
+}
+
+
+// lookup returns the node of path, asking S3 when it is not cached. Nodes
+// from a listing serve stat with the mount's mode and owner until their
+// entry expires.
+func (self *S3fs) lookup(path string) (*Node, int) {
+
+	return self.find(path, false)
+}
+
+
+// lookupMeta is lookup for callers that store the object's attributes
+// again, which a listed node does not know yet.
+func (self *S3fs) lookupMeta(path string) (*Node, int) {
+
+	return self.find(path, true)
+}
+
+
+func (self *S3fs) find(path string, meta bool) (*Node, int) {
+
+	node, hit := self.cache.Get(path)
+	if hit && node == nil {
+		return nil, -fuse.ENOENT
+	}
+	if hit && (!meta || node.isHeaded()) {
+		return node, 0
+	}
+
+	info, err := self.client.Stat(path)
+	if err != nil {
+		errc := fuseErrc(err)
+		if errc == -fuse.ENOENT {
+			self.cache.Miss(path)
+		} else {
+			fmt.Println(path, err)
+		}
+		return nil, errc
+	}
+	return self.cache.Put(path, info), 0
+}
+
+
+// update takes the attributes from a listing or HeadObject. The size of a
+// file being written is left alone, the open writer knows better.
+func (self *Node) update(info S3FileObject) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.writers > 0 {
+		return
+	}
+
+	if info.Meta != nil {
+		self.Meta = *info.Meta
+		self.headed = true
+	} else if info.ETag != self.ETag {
+		// replaced since it was read, metadata included
+		self.Meta = ObjectMeta{}
+		self.headed = false
+	}
+
+	self.Size = info.Size
+	self.Mtime = info.LastModified
+	self.ETag = info.ETag
+	if info.ContentType != "" {
+		self.ContentType = info.ContentType
+	}
+}
+
+
+func (self *Node) isHeaded() bool {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.headed
+}
+
+
+// busy tells whether the node has local changes that S3 does not know yet.
+func (self *Node) busy() bool {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.writers > 0 || self.flushing != nil
+}
+
+
+// waitFlushed waits for the background uploads of the node to end, leaving
+// their failure to settle.
+func (self *Node) waitFlushed() {
+
+	self.lock.Lock()
+	done := self.flushing
+	self.lock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+
+func (self *Node) path() string {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.Path
+}
+
+
+// size returns the node's current size.
+func (self *Node) size() int64 {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return int64(self.Size)
+}
+
+
+// openFile allocates a file handle for node.
+func (self *S3fs) openFile(node *Node, flags int) uint64 {
+
+	self.filelock.Lock()
+	defer self.filelock.Unlock()
+
+	self.filefh++
+	self.files[self.filefh] = &fileHandle{node: node, flags: flags}
+	return self.filefh
+}
+
+
+func (self *S3fs) getFile(fh uint64) (*fileHandle, bool) {
+
+	self.filelock.Lock()
+	defer self.filelock.Unlock()
+
+	file, found := self.files[fh]
+	return file, found
+}
+
+
+// closeFile frees the handle and returns it for the final cleanup.
+func (self *S3fs) closeFile(fh uint64) (*fileHandle, bool) {
+
+	self.filelock.Lock()
+	defer self.filelock.Unlock()
+
+	file, found := self.files[fh]
+	delete(self.files, fh)
+	return file, found
+}
+
+
+// reader returns the handle's view of the stored object, set up on the
+// first read.
+func (self *S3fs) reader(file *fileHandle) io.ReaderAt {
+
+	file.lock.Lock()
+	defer file.lock.Unlock()
+
+	if file.ra == nil {
+		// a failed background upload leaves the previous object to read
+		self.settle(file.node)
+
+		file.fp = self.client.Open(file.node.path())
+		file.ra = file.fp
+		if !self.client.config.NoReadAhead {
+			file.ra = NewReadAhead(file.fp, file.node.size(), self.client.config)
+		}
+	}
+	return file.ra
+}
+
+
+// writer returns the handle's write buffer, seeded with the stored object
+// on the first write unless fresh asks for an empty file.
+func (self *S3fs) writer(file *fileHandle, fresh bool) (*Writer, int) {
+
+	file.lock.Lock()
+	defer file.lock.Unlock()
+
+	if file.writer == nil {
+		errc := self.settle(file.node)
+		if errc != 0 {
+			return nil, errc
+		}
+
+		// the rewritten object keeps its attributes
+		node := file.node
+		if !node.isHeaded() {
+			_, errc := self.lookupMeta(node.path())
+			if errc != 0 && errc != -fuse.ENOENT {
+				return nil, errc
+			}
+		}
+
+		node.lock.Lock()
+		meta := node.Meta.uploadMeta()
+		node.lock.Unlock()
+
+		node.lock.Lock()
+		unlinked := node.unlinked
+		node.lock.Unlock()
+
+		existing := node.size()
+		if fresh || unlinked {
+			existing = 0
+		}
+		writer, err := self.client.NewWriter(node.path(), existing, meta)
+		if err != nil {
+			fmt.Println(node.path(), err)
+			return nil, fuseErrc(err)
+		}
+		if unlinked {
+			writer.Unlink()
+		}
+		file.writer = writer
+
+		node.lock.Lock()
+		node.writers++
+		node.lock.Unlock()
+	}
+	return file.writer, 0
+}
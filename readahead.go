@@ -0,0 +1,254 @@
+/*
+ * readahead.go
+ * Sequential read-ahead with parallel ranged prefetch
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+
+// Defaults for the readahead_* mount options.
+const (
+	defaultReadAheadChunk    = 2 << 20
+	defaultReadAheadMin      = 4 << 20
+	defaultReadAheadMax      = 64 << 20
+	defaultReadAheadParallel = 4
+)
+
+// reads in a row at the expected offset before prefetching starts
+const sequentialStreak = 2
+
+// the window aims to keep about this much transfer time in flight
+const readAheadHorizon = time.Second
+
+
+// ReadAhead serves reads of one open file. Random reads go straight to the
+// object; once reads turn sequential it prefetches the chunks ahead of the
+// reader with several concurrent ranged GETs. The window starts at
+// readahead_min and follows the observed transfer rate up to readahead_max.
+//
+// ReadAt is safe for concurrent use, as the kernel may issue overlapping
+// reads for one handle.
+type ReadAhead struct {
+
+	src      io.ReaderAt
+	size     int64    // object size, 0 if unknown
+	chunk    int64
+	min      int64
+	max      int64
+	sem      chan struct{}
+
+	lock     sync.Mutex
+	chunks   map[int64]*readChunk
+	next     int64    // offset a sequential reader asks for next
+	streak   int
+	window   int64
+	rate     float64  // bytes/s of a single fetch, moving average
+}
+
+
+type readChunk struct {
+
+	done     chan struct{}
+	data     []byte
+	err      error
+}
+
+
+// NewReadAhead wraps src, an object of the given size, with the read-ahead
+// limits from the mount config.
+func NewReadAhead(src io.ReaderAt, size int64, config S3Config) *ReadAhead {
+
+	ra := &ReadAhead{
+		src:    src,
+		size:   size,
+		chunk:  int64(config.ReadAheadChunk),
+		min:    int64(config.ReadAheadMin),
+		max:    int64(config.ReadAheadMax),
+		chunks: make(map[int64]*readChunk),
+	}
+
+	parallel := config.ReadAheadParallel
+	if parallel <= 0 {
+		parallel = defaultReadAheadParallel
+	}
+	if ra.chunk <= 0 {
+		ra.chunk = defaultReadAheadChunk
+	}
+	if ra.min <= 0 {
+		ra.min = defaultReadAheadMin
+	}
+	if ra.max <= 0 {
+		ra.max = defaultReadAheadMax
+	}
+	if ra.max < ra.min {
+		ra.max = ra.min
+	}
+
+	ra.sem = make(chan struct{}, parallel)
+	ra.window = ra.min
+	return ra
+}
+
+
+func (self *ReadAhead) ReadAt(p []byte, off int64) (int, error) {
+
+	end := off + int64(len(p))
+
+	self.lock.Lock()
+
+	// the kernel may reorder reads slightly, anything within a chunk of
+	// where the last read ended still counts as sequential
+	if off >= self.next-self.chunk && off <= self.next+self.chunk {
+		self.streak++
+	} else {
+		// seek: drop the window and start over
+		self.streak = 0
+		self.window = self.min
+		self.chunks = make(map[int64]*readChunk)
+	}
+	if end > self.next || self.streak == 0 {
+		self.next = end
+	}
+
+	if self.streak < sequentialStreak {
+		self.lock.Unlock()
+		return self.src.ReadAt(p, off)
+	}
+
+	// schedule everything up to the window, forget what is behind the reader
+	first := off / self.chunk
+	last := (end + self.window - 1) / self.chunk
+	if self.size > 0 && last > (self.size-1)/self.chunk {
+		last = (self.size - 1) / self.chunk
+	}
+	for i := range self.chunks {
+		if i < first {
+			delete(self.chunks, i)
+		}
+	}
+	for i := first; i <= last; i++ {
+		self.get(i)
+	}
+
+	self.lock.Unlock()
+
+
+	n := 0
+	for n < len(p) {
+
+		pos := off + int64(n)
+		i := pos / self.chunk
+
+		self.lock.Lock()
+		c := self.get(i)
+		self.lock.Unlock()
+
+		<-c.done
+		if c.err != nil {
+			return n, c.err
+		}
+
+		start := pos - i*self.chunk
+		if start >= int64(len(c.data)) {
+			break
+		}
+		n += copy(p[n:], c.data[start:])
+
+		// short chunk, end of object
+		if int64(len(c.data)) < self.chunk && n < len(p) {
+			break
+		}
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+
+// get returns chunk i, starting its fetch if needed. Called with the lock
+// held.
+func (self *ReadAhead) get(i int64) *readChunk {
+
+	if c, found := self.chunks[i]; found {
+		return c
+	}
+
+	c := &readChunk{done: make(chan struct{})}
+	self.chunks[i] = c
+
+	go func() {
+
+		self.sem <- struct{}{}
+		defer func() { <-self.sem }()
+
+		start := time.Now()
+		buf := make([]byte, self.chunk)
+		n, err := self.src.ReadAt(buf, i*self.chunk)
+		if err == io.EOF {
+			err = nil
+		}
+		c.data, c.err = buf[:n], err
+
+		if err == nil && n > 0 {
+			self.observe(n, time.Since(start))
+		}
+		close(c.done)
+	}()
+
+	return c
+}
+
+
+// observe folds one completed fetch into the transfer rate and resizes the
+// window to cover readAheadHorizon at that rate across all parallel fetches.
+func (self *ReadAhead) observe(n int, elapsed time.Duration) {
+
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(n) / elapsed.Seconds()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.rate == 0 {
+		self.rate = rate
+	} else {
+		self.rate = 0.7*self.rate + 0.3*rate
+	}
+
+	window := int64(self.rate * float64(cap(self.sem)) * readAheadHorizon.Seconds())
+	if window < self.min {
+		window = self.min
+	}
+	if window > self.max {
+		window = self.max
+	}
+	self.window = window
+}
+
+
+// Close drops all buffered chunks. Fetches still in flight finish in the
+// background and are discarded.
+func (self *ReadAhead) Close() {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.chunks = make(map[int64]*readChunk)
+}
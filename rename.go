@@ -0,0 +1,277 @@
+/*
+ * rename.go
+ * Rename of files and directory trees with server-side copies
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// Move renames one object: a server-side copy, then the delete.
+func (self *S3) Move(src string, dst string, size int64) error {
+
+	_, _, err := self.copyObject(self.key(src), self.key(dst), size, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return self.store.Delete(self.key(src))
+}
+
+
+// MoveTree renames directory src, marker and everything below it, to dst.
+// Objects are copied copy_concurrency at a time, and the originals are only
+// deleted once every copy succeeded, so a failure leaves src complete.
+func (self *S3) MoveTree(src string, dst string) error {
+
+	srcPrefix := self.key(src) + "/"
+	dstPrefix := self.key(dst) + "/"
+
+	objects, err := self.listAll(srcPrefix)
+	if err != nil {
+		return err
+	}
+
+	var lock sync.Mutex
+	var failed error
+
+	sem := make(chan struct{}, self.copyConcurrency())
+	var wg sync.WaitGroup
+
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+
+		sem <- struct{}{}
+		lock.Lock()
+		stop := failed != nil
+		lock.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+
+		key := obj.Key
+		keys = append(keys, key)
+
+		wg.Add(1)
+		go func(key string, size int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			dstKey := dstPrefix + strings.TrimPrefix(key, srcPrefix)
+			_, _, err := self.copyObject(key, dstKey, size, nil, nil)
+			if err != nil {
+				lock.Lock()
+				if failed == nil {
+					failed = err
+				}
+				lock.Unlock()
+			}
+		}(key, obj.Size)
+	}
+	wg.Wait()
+
+	if failed != nil {
+		return failed
+	}
+	return self.deleteKeys(keys)
+}
+
+
+// Rename without flags, for FUSE2.
+func (self *S3fs) Rename(oldpath string, newpath string) (errc int) {
+
+	return self.Rename3(oldpath, newpath, 0)
+}
+
+
+// Rename3 follows rename(2) and renameat2(2) with RENAME_NOREPLACE and
+// RENAME_EXCHANGE. S3 has no rename, every object involved is copied and
+// deleted, so renaming a large tree is neither fast nor atomic.
+func (self *S3fs) Rename3(oldpath string, newpath string, flags uint32) (errc int) {
+
+	const known = fuse.RENAME_NOREPLACE | fuse.RENAME_EXCHANGE
+	if flags&^known != 0 || flags == known {
+		return -fuse.EINVAL
+	}
+	if oldpath == "/" || newpath == "/" {
+		return -fuse.EBUSY
+	}
+	// a directory cannot move below itself
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return -fuse.EINVAL
+	}
+
+	src, errc := self.lookup(oldpath)
+	if errc != 0 {
+		return errc
+	}
+	if oldpath == newpath {
+		return 0
+	}
+
+	dst, errc := self.lookup(newpath)
+	if errc != 0 && errc != -fuse.ENOENT {
+		return errc
+	}
+	exists := errc == 0
+
+	if flags&fuse.RENAME_EXCHANGE != 0 {
+		if !exists {
+			return -fuse.ENOENT
+		}
+		if strings.HasPrefix(oldpath, newpath+"/") {
+			return -fuse.EINVAL
+		}
+		return self.exchange(src, dst)
+	}
+
+	if exists {
+		switch {
+		case flags&fuse.RENAME_NOREPLACE != 0:
+			return -fuse.EEXIST
+		case src.IsDir && !dst.IsDir:
+			return -fuse.ENOTDIR
+		case !src.IsDir && dst.IsDir:
+			return -fuse.EISDIR
+		case dst.IsDir:
+			empty, err := self.client.Empty(newpath)
+			if err != nil {
+				fmt.Println(newpath, err)
+				return fuseErrc(err)
+			}
+			if !empty {
+				return -fuse.ENOTEMPTY
+			}
+		}
+	}
+
+	err := self.move(src, newpath)
+	if err != nil {
+		fmt.Println(oldpath, err)
+		return fuseErrc(err)
+	}
+	return 0
+}
+
+
+// exchange swaps two paths through a temporary name next to b.
+func (self *S3fs) exchange(a *Node, b *Node) (errc int) {
+
+	apath, bpath := a.path(), b.path()
+	tmp := fmt.Sprintf("%s.s3fs-exchange-%d", bpath, time.Now().UnixNano())
+
+	err := self.move(b, tmp)
+	if err == nil {
+		err = self.move(a, bpath)
+		if err != nil {
+			// put b back
+			self.move(b, bpath)
+		}
+	}
+	if err == nil {
+		err = self.move(b, apath)
+	}
+	if err != nil {
+		fmt.Println(apath, bpath, err)
+		return fuseErrc(err)
+	}
+	return 0
+}
+
+
+// move renames node to newpath. Open handles follow: what their writers
+// hold is stored first, so that the copy includes it, and later writes go
+// to the new name.
+func (self *S3fs) move(node *Node, newpath string) error {
+
+	oldpath := node.path()
+
+	// background uploads must land before they can be copied
+	if node.IsDir {
+		self.settleUnder(oldpath)
+	} else if errc := self.settle(node); errc != 0 {
+		return fuse.Error(-errc)
+	}
+
+	for _, file := range self.filesUnder(oldpath) {
+		file.lock.Lock()
+		if file.writer != nil {
+			fpath := newpath + strings.TrimPrefix(file.node.path(), oldpath)
+			err := file.writer.Move(fpath)
+			if err != nil {
+				file.lock.Unlock()
+				return err
+			}
+		}
+		// reopen at the new name on the next read
+		if ra, ok := file.ra.(*ReadAhead); ok {
+			ra.Close()
+		}
+		file.fp = nil
+		file.ra = nil
+		file.lock.Unlock()
+	}
+
+	var err error
+	if node.IsDir {
+		err = self.client.MoveTree(oldpath, newpath)
+	} else {
+		err = self.client.Move(oldpath, newpath, node.size())
+	}
+	if err != nil {
+		return err
+	}
+
+	self.cache.Rename(oldpath, newpath)
+	return nil
+}
+
+
+// filesUnder returns the open handles of fpath and, for a directory, of
+// everything below it.
+func (self *S3fs) filesUnder(fpath string) []*fileHandle {
+
+	self.filelock.Lock()
+	defer self.filelock.Unlock()
+
+	var files []*fileHandle
+	for _, file := range self.files {
+		if under(file.node.path(), fpath) {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+
+// settleUnder waits for the background uploads of fpath and everything
+// below it.
+func (self *S3fs) settleUnder(fpath string) {
+
+	self.settleWhere(func(node *Node) bool {
+		return under(node.path(), fpath)
+	})
+}
+
+
+// under tells whether p is fpath or below it.
+func under(p string, fpath string) bool {
+
+	return p == fpath || strings.HasPrefix(p, fpath+"/")
+}
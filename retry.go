@@ -0,0 +1,351 @@
+/*
+ * retry.go
+ * Retry policy and timeouts shared by every S3 request
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// Defaults for the retry_* and *_timeout options.
+const (
+	defaultRetryMaxAttempts = 6
+	defaultRetryBaseDelay   = 100 * time.Millisecond
+	defaultRetryMaxDelay    = 20 * time.Second
+	defaultRequestTimeout   = 30 * time.Second
+	defaultTotalTimeout     = 2 * time.Minute
+)
+
+
+// RetryStats counts what the retry policy did since the mount, for
+// diagnosis. Fields are updated atomically.
+type RetryStats struct {
+
+	Requests  uint64 // attempts sent, retries included
+	Retries   uint64
+	Throttled uint64 // retries after SlowDown and the like
+	Server    uint64 // retries after a 5xx
+	Timeouts  uint64 // retries after a timeout
+	GaveUp    uint64 // failures that were retryable but out of attempts or time
+}
+
+
+func (self *RetryStats) String() string {
+
+	return fmt.Sprintf("requests %d, retries %d (throttled %d, server errors %d, timeouts %d), gave up %d",
+		atomic.LoadUint64(&self.Requests), atomic.LoadUint64(&self.Retries),
+		atomic.LoadUint64(&self.Throttled), atomic.LoadUint64(&self.Server),
+		atomic.LoadUint64(&self.Timeouts), atomic.LoadUint64(&self.GaveUp))
+}
+
+
+// retryPolicy is the request.Retryer of the S3 client, so every call goes
+// through it: the wrapper in s3fs.go, File, the uploader and the copies.
+// Throttling, 5xx answers, timeouts and dropped connections are retried
+// with full-jitter exponential backoff, until retry_max_attempts attempts
+// were made or the next one would start past total_timeout. The deadlines
+// themselves are set by AWSStore, see attemptTimeout.
+type retryPolicy struct {
+
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	total       time.Duration
+	stats       *RetryStats
+}
+
+
+func newRetryPolicy(config S3Config, stats *RetryStats) *retryPolicy {
+
+	policy := &retryPolicy{
+		maxAttempts: config.RetryMaxAttempts,
+		baseDelay:   config.RetryBaseDelay,
+		maxDelay:    config.RetryMaxDelay,
+		total:       totalTimeout(config),
+		stats:       stats,
+	}
+
+	if policy.maxAttempts <= 0 {
+		policy.maxAttempts = defaultRetryMaxAttempts
+	}
+	if policy.baseDelay <= 0 {
+		policy.baseDelay = defaultRetryBaseDelay
+	}
+	if policy.maxDelay <= 0 {
+		policy.maxDelay = defaultRetryMaxDelay
+	}
+	return policy
+}
+
+
+func (self *retryPolicy) MaxRetries() int {
+
+	return self.maxAttempts - 1
+}
+
+
+// RetryRules returns the delay before the next attempt, random up to
+// base_delay * 2^retries, capped at max_delay. The SDK only asks when it
+// does retry, so this is where retries are counted.
+func (self *retryPolicy) RetryRules(r *request.Request) time.Duration {
+
+	delay := time.Duration(rand.Int63n(int64(self.backoff(r.RetryCount)) + 1))
+
+	atomic.AddUint64(&self.stats.Retries, 1)
+	switch retryReason(r) {
+	case "throttled":
+		atomic.AddUint64(&self.stats.Throttled, 1)
+	case "server error":
+		atomic.AddUint64(&self.stats.Server, 1)
+	case "timeout":
+		atomic.AddUint64(&self.stats.Timeouts, 1)
+	}
+
+	fmt.Printf("retry %s %s in %v, attempt %d of %d: %v\n", r.Operation.Name,
+		retryReason(r), delay.Round(time.Millisecond), r.RetryCount+2, self.maxAttempts, r.Error)
+	return delay
+}
+
+
+func (self *retryPolicy) ShouldRetry(r *request.Request) bool {
+
+	if retryReason(r) == "" {
+		return false
+	}
+	if r.RetryCount >= self.MaxRetries() {
+		atomic.AddUint64(&self.stats.GaveUp, 1)
+		return false
+	}
+	// no point waiting for an attempt that starts past the deadline
+	if self.total > 0 && time.Since(r.Time)+self.backoff(r.RetryCount) > self.total {
+		atomic.AddUint64(&self.stats.GaveUp, 1)
+		return false
+	}
+	return true
+}
+
+
+// backoff is the longest delay before retry n+1.
+func (self *retryPolicy) backoff(n int) time.Duration {
+
+	if n < 32 && self.baseDelay<<uint(n) < self.maxDelay {
+		return self.baseDelay << uint(n)
+	}
+	return self.maxDelay
+}
+
+
+// retryReason tells why a failed request is worth another attempt, or ""
+// when it is not.
+func retryReason(r *request.Request) string {
+
+	if r.Error == nil {
+		return ""
+	}
+
+	var aerr awserr.Error
+	if errors.As(r.Error, &aerr) && aerr.Code() == request.CanceledErrorCode {
+		return ""
+	}
+
+	switch {
+	case r.IsErrorThrottle():
+		return "throttled"
+	case r.HTTPResponse != nil && r.HTTPResponse.StatusCode >= 500 && r.HTTPResponse.StatusCode != 501:
+		return "server error"
+	case fuseErrc(r.Error) == -fuse.ETIMEDOUT:
+		return "timeout"
+	case r.IsErrorRetryable():
+		return "transient"
+	}
+	return ""
+}
+
+
+// countAttempts is a Send handler counting every attempt.
+func countAttempts(stats *RetryStats) request.NamedHandler {
+
+	return request.NamedHandler{
+		Name: "s3fs.countAttempts",
+		Fn: func(r *request.Request) {
+			atomic.AddUint64(&stats.Requests, 1)
+		},
+	}
+}
+
+
+// requestTimeout is the time one attempt may wait for the server to answer.
+func requestTimeout(config S3Config) time.Duration {
+
+	if config.RequestTimeout == 0 {
+		return defaultRequestTimeout
+	}
+	if config.RequestTimeout < 0 {
+		return 0
+	}
+	return config.RequestTimeout
+}
+
+
+// totalTimeout is the time one operation may take, retries included.
+func totalTimeout(config S3Config) time.Duration {
+
+	if config.TotalTimeout == 0 {
+		return defaultTotalTimeout
+	}
+	if config.TotalTimeout < 0 {
+		return 0
+	}
+	return config.TotalTimeout
+}
+
+
+// attemptTimeout gives every attempt of a request its own deadline: it fails
+// with RequestTimeout, which is retried, when the server has not answered
+// timeout after the last byte of the request went out. The response body is
+// left to WithResponseReadTimeout.
+func attemptTimeout(timeout time.Duration) request.Option {
+
+	return func(r *request.Request) {
+
+		var lock sync.Mutex
+		var cancel context.CancelFunc
+		var timer *time.Timer
+		expired, answered := false, false
+
+		// an upload that moves is not stalled
+		progress := func() {
+			lock.Lock()
+			if timer != nil && !answered {
+				timer.Reset(timeout)
+			}
+			lock.Unlock()
+		}
+
+		r.Handlers.Send.PushFront(func(r *request.Request) {
+			ctx, c := context.WithCancel(r.Context())
+			lock.Lock()
+			cancel, expired, answered = c, false, false
+			timer = time.AfterFunc(timeout, func() {
+				lock.Lock()
+				expired = true
+				lock.Unlock()
+				c()
+			})
+			lock.Unlock()
+
+			r.HTTPRequest = r.HTTPRequest.WithContext(ctx)
+			if body := r.HTTPRequest.Body; body != nil && body != request.NoBody {
+				r.HTTPRequest.Body = &progressBody{ReadCloser: body, progress: progress}
+			}
+		})
+
+		// the headers are in
+		r.Handlers.Send.PushBack(func(r *request.Request) {
+			lock.Lock()
+			answered = true
+			if timer != nil {
+				timer.Stop()
+			}
+			lock.Unlock()
+		})
+
+		r.Handlers.CompleteAttempt.PushBack(func(r *request.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			if timer == nil {
+				return
+			}
+			timer.Stop()
+			cancel()
+			// signing the next attempt looks at this context too
+			r.HTTPRequest = r.HTTPRequest.WithContext(r.Context())
+			if expired && r.Error != nil {
+				r.Error = awserr.New("RequestTimeout", fmt.Sprintf("no answer in %v", timeout), r.Error)
+			}
+			timer = nil
+		})
+	}
+}
+
+
+// progressBody reports every read of an upload.
+type progressBody struct {
+
+	io.ReadCloser
+	progress func()
+}
+
+
+func (self *progressBody) Read(p []byte) (int, error) {
+
+	self.progress()
+	return self.ReadCloser.Read(p)
+}
+
+
+// retryBody tells whether to fetch the rest of a GetObject again after its
+// body failed part way, and how long to wait first. The SDK is done with
+// the request by then, so this applies the limits of the policy itself:
+// attempt is the number of fetches so far, start when the first began.
+func (self *retryPolicy) retryBody(attempt int, start time.Time, err error) (time.Duration, bool) {
+
+	if !bodyRetryable(err) {
+		return 0, false
+	}
+	if attempt >= self.maxAttempts ||
+		(self.total > 0 && time.Since(start)+self.backoff(attempt-1) > self.total) {
+		atomic.AddUint64(&self.stats.GaveUp, 1)
+		return 0, false
+	}
+
+	delay := time.Duration(rand.Int63n(int64(self.backoff(attempt-1)) + 1))
+	atomic.AddUint64(&self.stats.Retries, 1)
+	if fuseErrc(err) == -fuse.ETIMEDOUT {
+		atomic.AddUint64(&self.stats.Timeouts, 1)
+	}
+	fmt.Printf("retry GetObject body in %v, attempt %d of %d: %v\n",
+		delay.Round(time.Millisecond), attempt+1, self.maxAttempts, err)
+	return delay, true
+}
+
+
+// bodyRetryable tells a connection that stalled or was cut in the middle of
+// a body from the end of the object or the end of the operation.
+func bodyRetryable(err error) bool {
+
+	if err == nil || err == io.EOF ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	switch fuseErrc(err) {
+	case -fuse.ETIMEDOUT, -fuse.ECONNRESET:
+		return true
+	}
+	return false
+}
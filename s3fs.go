@@ -1,6 +1,6 @@
 /*
  * s3fs-fuse.go
- * Windows FUSE-based file system backed by Amazon S3
+ * FUSE file system backed by Amazon S3
  * Copyright 2022 Daniel Vanderloo
  */
 /*
@@ -18,46 +18,50 @@ import (
 	
 	"github.com/winfsp/cgofuse/fuse"
 	
-	//"io"
+	"io"
 	//"path"
 
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	//"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	
 	"bytes"
-	"io/ioutil"
+	//"io/ioutil"
 	//"net/http"
-	"errors"
+	//"errors"
 	
 	//"github.com/eikenb/pipeat"
 )
 
 
 
-// set CPATH=C:\Program Files (x86)\WinFsp\inc\fuse
-
-
-type S3Config struct {
-	
-	SecretAccessKey string 
-	AccessKeyId     string
-	Region          string
-}
+// Linux builds against the libfuse 2 headers (libfuse-dev); Windows against
+// WinFsp, with set CPATH=C:\Program Files (x86)\WinFsp\inc\fuse
 
 
+// S3 is the file system's view of the bucket: paths, directories and files
+// made of objects in an ObjectStore.
 type S3 struct {
 	
-	client *aws_s3.S3
-	bucket string 
+	store  ObjectStore
 	config S3Config
-	uploader *s3manager.Uploader
+	creds  *credentials.Credentials
+	stats  *RetryStats
+	retry  *retryPolicy
+	staging  *StagingArea
+	
+	// multipart uploads, see putObject
+	partSize    int64
+	concurrency int
 }
 
 
@@ -67,197 +71,373 @@ type S3FileObject struct {
 	Name          string
 	Size          int
 	LastModified  time.Time
+	ETag          string
+	ContentType   string
+	Meta          *ObjectMeta   // nil when listed, HeadObject reads it
 }
 
 
-func (self *S3) ReadDir(dirname string) ([]S3FileObject, error) {
+// key maps a FUSE path to its object key under the configured prefix.
+func (self *S3) key(fpath string) string {
+
+	key := strings.TrimPrefix(fpath, "/")
+	if self.config.Prefix == "" {
+		return key
+	}
+	if key == "" {
+		return self.config.Prefix
+	}
+	return self.config.Prefix + "/" + key
+}
+
+
+// ReadDirPage lists one page of a directory starting at the continuation
+// token ("" for the first page). It returns the token for the next page, or
+// "" after the last one.
+func (self *S3) ReadDirPage(dirname string, token string) ([]S3FileObject, string, error) {
 
 	var err error
 	var arr []S3FileObject
 
-	input := aws_s3.ListObjectsV2Input{}
-	input.Bucket = aws.String(self.bucket)
-	input.Delimiter = aws.String("/")
-	
-	if dirname != "/" {
-		input.Prefix = aws.String(dirname[1:] + "/")
+	prefix := ""
+	if key := self.key(dirname); key != "" {
+		prefix = key + "/"
 	}
 
-	resp, err := self.client.ListObjectsV2(&input)
+	page, err := self.store.List(prefix, "/", token, self.config.ListPageSize)
 	if err != nil {
-		return arr, err
+		return arr, "", err
 	}
 	
-	//fmt.Printf("%+v\n", resp)
-	
-	
 	// dir
-	for _, item := range resp.CommonPrefixes {
+	for _, item := range page.Prefixes {
 	
 		obj := S3FileObject{}
 		obj.IsDir = true
-		obj.Name = path.Base(path.Dir(*item.Prefix))
+		obj.Name = path.Base(item)
 		arr = append(arr, obj)
-    }	
+	}
 	
 	// files
-	for _, item := range resp.Contents {
+	for _, item := range page.Objects {
 	
-		name := *item.Key
+		name := item.Key
 		last := name[len(name)-1:]
 		if last != "/" {
 			obj := S3FileObject{}
 			obj.IsDir = false
 			obj.Name = path.Base(name)
-			obj.LastModified = *item.LastModified
-			obj.Size = int(*item.Size)
+			obj.LastModified = item.LastModified
+			obj.Size = int(item.Size)
+			obj.ETag = item.ETag
 			arr = append(arr, obj)		
 		}
-    }
+	}
 	
-
-	return arr, err
+	return arr, page.Next, nil
 }
 
 
-func (self *S3) Open(fpath string) (*bytes.Reader, error) {
-
-	var err error
-	reader := new(bytes.Reader)
+// ReadDir lists a whole directory, following every page.
+func (self *S3) ReadDir(dirname string) ([]S3FileObject, error) {
 
-	r, err := self.client.GetObject(&aws_s3.GetObjectInput{
-		Bucket: aws.String(self.bucket),
-		Key:    aws.String(fpath),
-	})
+	var arr []S3FileObject
+	token := ""
 
-	arr, err := ioutil.ReadAll(r.Body)
-    if err != nil {
-        return reader, err
-    }	
-	
-	reader = bytes.NewReader(arr)
-	return reader, err
+	for {
+		page, next, err := self.ReadDirPage(dirname, token)
+		if err != nil {
+			return arr, err
+		}
+		arr = append(arr, page...)
 
+		if next == "" {
+			return arr, nil
+		}
+		token = next
+	}
 }
 
 
-func (self *S3) Create(fpath string, bs []byte) (error) {
+// Stat looks up a single path: the object itself, or else any object under
+// it, which makes it an implicit directory.
+func (self *S3) Stat(fpath string) (S3FileObject, error) {
 
-	var err error
-	buf := &bytes.Buffer{}
-	buf.Write(bs)
+	obj := S3FileObject{Name: path.Base(fpath)}
+	key := self.key(fpath)
 
-	go func() {
+	head, err := self.store.Head(key)
+	if err == nil {
+		obj.Size = int(head.Size)
+		obj.LastModified = head.LastModified
+		obj.ETag = head.ETag
+		obj.ContentType = head.ContentType
+		meta := parseMeta(head.Metadata)
+		obj.Meta = &meta
+		return obj, nil
+	}
+	if fuseErrc(err) != -fuse.ENOENT {
+		return obj, err
+	}
+
+	// directory marker or implicit directory
+	list, lerr := self.store.List(key + "/", "", "", 1)
+	if lerr != nil {
+		return obj, lerr
+	}
+	if len(list.Objects) == 0 && len(list.Prefixes) == 0 {
+		return obj, err
+	}
 
-		dpath := fpath[1:]
-		fmt.Println(dpath)
+	obj.IsDir = true
+	obj.Meta = &ObjectMeta{}
+	if len(list.Objects) > 0 && list.Objects[0].Key == key + "/" {
+		obj.LastModified = list.Objects[0].LastModified
 		
-		req := &aws_s3.PutObjectInput{
-			Bucket: aws.String(self.bucket),
-			Key:    aws.String(dpath),
-			Body:   bytes.NewReader(buf.Bytes()),
-			ACL:    aws.String("private"),
-		}
-		_, err = self.client.PutObject(req)
-		if err != nil {
-			//return err
+		// the marker holds the directory's attributes
+		marker, err := self.store.Head(key + "/")
+		if err == nil {
+			meta := parseMeta(marker.Metadata)
+			obj.Meta = &meta
 		}
-	
-	}()
-	
-	return err
+	}
+	return obj, nil
 }
 
+
+// Open returns a File for ranged reads; nothing is fetched until ReadAt.
+func (self *S3) Open(fpath string) (*File) {
+
+	return NewFile(self, self.key(fpath))
+}
+
+
 func (self *S3) Remove(fpath string) (error) {
 
-	dpath := fpath[1:]
+	dpath := self.key(fpath)
 	fmt.Println(dpath)
 	
-	req := &aws_s3.DeleteObjectInput{
-		Bucket: aws.String(self.bucket),
-		Key:    aws.String(dpath),
-	}
-	_, err := self.client.DeleteObject(req)
-	if err != nil {
-		return err
-	}
-	
+	return self.store.Delete(dpath)
+}
+
+
+// Create stores an empty object at fpath, unless one exists. The check is
+// a conditional PUT, which fails with PreconditionFailed where the server
+// supports it; others overwrite.
+func (self *S3) Create(fpath string, meta ObjectMeta) (error) {
+
+	_, err := self.store.Put(self.key(fpath), bytes.NewReader(nil), PutOptions{
+		Metadata:    meta.headers(nil),
+		IfNoneMatch: true,
+	})
+	return err
+}
+
+
+// Touch stores an empty object at fpath.
+func (self *S3) Touch(fpath string, meta ObjectMeta) (error) {
+
+	_, err := self.store.Put(self.key(fpath), bytes.NewReader(nil), PutOptions{Metadata: meta.headers(nil)})
 	return err
 }
 
 
 func (self *S3) Rmdir(fpath string) (error) {
 
-	dpath := fpath[1:] + "/"
+	dpath := self.key(fpath) + "/"
 	fmt.Println(dpath)
 	
-	req := &aws_s3.DeleteObjectInput{
-		Bucket: aws.String(self.bucket),
-		Key:    aws.String(dpath),
-	}
-	_, err := self.client.DeleteObject(req)
+	return self.store.Delete(dpath)
+}
+
+
+// Empty tells whether directory fpath holds nothing but its marker.
+func (self *S3) Empty(fpath string) (bool, error) {
+
+	dpath := self.key(fpath) + "/"
+	
+	page, err := self.store.List(dpath, "", "", 2)
 	if err != nil {
-		return err
+		return false, err
 	}
 	
-	return err
+	for _, item := range page.Objects {
+		if item.Key != dpath {
+			return false, nil
+		}
+	}
+	return len(page.Prefixes) == 0, nil
 }
 
 
-func (self *S3) Mkdir(fpath string, bs []byte) (error) {
+// RemoveTree deletes every object below directory fpath, a listing page
+// (up to 1000 keys) per DeleteObjects call.
+func (self *S3) RemoveTree(fpath string) error {
 
-	var err error
-	buf := &bytes.Buffer{}
-	buf.Write(bs)
+	prefix := self.key(fpath) + "/"
+	token := ""
+	
+	for {
+		page, err := self.store.List(prefix, "", token, 0)
+		if err != nil {
+			return err
+		}
+		
+		keys := make([]string, len(page.Objects))
+		for i, item := range page.Objects {
+			keys[i] = item.Key
+		}
+		err = self.deleteKeys(keys)
+		if err != nil {
+			return err
+		}
+		
+		if page.Next == "" {
+			return nil
+		}
+		token = page.Next
+	}
+}
 
-	dpath := fpath[1:] + "/"
-	fmt.Println(dpath)
+
+// listAll lists every object under prefix.
+func (self *S3) listAll(prefix string) ([]ObjectInfo, error) {
+
+	var objects []ObjectInfo
+	token := ""
 	
-	req := &aws_s3.PutObjectInput{
-		Bucket: aws.String(self.bucket),
-		Key:    aws.String(dpath),
-		Body:   bytes.NewReader(buf.Bytes()),
-		ACL:    aws.String("private"),
+	for {
+		page, err := self.store.List(prefix, "", token, 0)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, page.Objects...)
+		
+		if page.Next == "" {
+			return objects, nil
+		}
+		token = page.Next
 	}
-	_, err = self.client.PutObject(req)
-	if err != nil {
-		return err
+}
+
+
+// deleteKeys removes objects with DeleteObjects, 1000 keys per request.
+func (self *S3) deleteKeys(keys []string) error {
+
+	for len(keys) > 0 {
+		
+		n := len(keys)
+		if n > 1000 {
+			n = 1000
+		}
+		
+		err := self.store.DeleteKeys(keys[:n])
+		if err != nil {
+			return err
+		}
+		
+		keys = keys[n:]
 	}
 	
+	return nil
+}
+
+
+func (self *S3) Mkdir(fpath string, bs []byte, meta ObjectMeta) (error) {
+
+	dpath := self.key(fpath) + "/"
+	fmt.Println(dpath)
+	
+	_, err := self.store.Put(dpath, bytes.NewReader(bs), PutOptions{Metadata: meta.headers(nil)})
 	return err
 }
 
 
+// NewS3 sets up the file system's view of store.
+func NewS3(store ObjectStore, config S3Config) *S3 {
+
+	s3 := &S3{
+		store:       store,
+		config:      config,
+		stats:       &RetryStats{},
+		partSize:    defaultPartSize,
+		concurrency: defaultUploadConcurrency,
+	}
+	s3.retry = newRetryPolicy(config, s3.stats)
+	if config.PartSize > 0 {
+		s3.partSize = int64(config.PartSize)
+	}
+	if config.UploadConcurrency > 0 {
+		s3.concurrency = config.UploadConcurrency
+	}
+	
+	limit := int64(config.StagingLimit)
+	if limit <= 0 {
+		limit = defaultStagingLimit
+	}
+	s3.staging = NewStagingArea(config.StagingDir, limit)
+	
+	return s3
+}
+
+
+// NewClient connects to bucket on S3 or the configured S3-compatible server.
 func NewClient(bucketName string, config S3Config) (*S3, error) {
 	
 	var err error
-	s3 := new(S3)
 	
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(config.Region),
-		Credentials: credentials.NewStaticCredentials(config.SecretAccessKey, config.AccessKeyId, ""),
-	})
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	
+	if config.PartSize > 0 && config.PartSize < minPartSize {
+		return nil, fmt.Errorf("part_size must be at least %d", minPartSize)
+	}
 	
+	awsConfig := &aws.Config{
+		Region:      aws.String(region),
+	}
+	err = endpointConfig(awsConfig, config)
 	if err != nil {
-		return s3, err
+		return nil, err
 	}
 	
-	svc := aws_s3.New(sess)	
-	uploader := s3manager.NewUploader(sess)
+	sess, err := session.NewSession(awsConfig)
 	
-	s3.client  = svc
-	s3.config  = config
-	s3.bucket  = bucketName
-	s3.uploader = uploader
+	if err != nil {
+		return nil, err
+	}
 	
-	//result, err := svc.ListBuckets(&aws_s3.ListBucketsInput{})
-	//if err != nil {
-	//	return s3, err
-    //}
-	//fmt.Printf("%+v\n", result)
+	// the credential providers keep the SDK's client and retries, which
+	// give up quickly where there is no instance metadata
+	creds := NewCredentials(sess, config)
+	sess = sess.Copy(&aws.Config{Credentials: creds})
 	
+	client, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	stats := &RetryStats{}
+	retry := newRetryPolicy(config, stats)
+	s3Config := request.WithRetryer(&aws.Config{
+		HTTPClient:              client,
+		EnforceShouldRetryCheck: aws.Bool(true),
+	}, retry)
 	
-	return s3, err
+	svc := aws_s3.New(sess, s3Config)	
+	svc.Handlers.Send.PushFrontNamed(countAttempts(stats))
+	err = setSignatureVersion(svc, config, bucketName, *awsConfig.S3ForcePathStyle)
+	if err != nil {
+		return nil, err
+	}
+	
+	s3 := NewS3(NewAWSStore(svc, bucketName, config), config)
+	s3.creds = creds
+	s3.stats = stats
+	s3.retry = retry
+	
+	return s3, nil
 }
 
 
@@ -270,92 +450,54 @@ func NewClient(bucketName string, config S3Config) (*S3, error) {
 
 
 
-// WriteBuffer is a simple type that implements io.WriterAt on an in-memory buffer.
-// The zero value of this type is an empty buffer ready to use.
-type WriteBuffer struct {
-    d []byte
-    m int
-}
-
-// NewWriteBuffer creates and returns a new WriteBuffer with the given initial size and
-// maximum. If maximum is <= 0 it is unlimited.
-func NewWriteBuffer(size, max int) *WriteBuffer {
-    if max < size && max >= 0 {
-        max = size
-    }
-    return &WriteBuffer{make([]byte, size), max}
-}
-
-// SetMax sets the maximum capacity of the WriteBuffer. If the provided maximum is lower
-// than the current capacity but greater than 0 it is set to the current capacity, if
-// less than or equal to zero it is unlimited..
-func (wb *WriteBuffer) SetMax(max int) {
-    if max < len(wb.d) && max >= 0 {
-        max = len(wb.d)
-    }
-    wb.m = max
-}
-
-// Bytes returns the WriteBuffer's underlying data. This value will remain valid so long
-// as no other methods are called on the WriteBuffer.
-func (wb *WriteBuffer) Bytes() []byte {
-    return wb.d
-}
-
-// Shape returns the current WriteBuffer size and its maximum if one was provided.
-func (wb *WriteBuffer) Shape() (int, int) {
-    return len(wb.d), wb.m
+// Directory handle, remembers where each listing page started so that a
+// Readdir resumed at an offset does not list the directory from the start.
+type dirHandle struct {
+	
+	pages   []dirPage
+	
+	cached  []S3FileObject   // listing served from the cache
+	listed  []S3FileObject   // entries listed so far, for the cache
+	partial bool             // listed misses entries, it is not cached
 }
 
-func (wb *WriteBuffer) WriteAt(dat []byte, off int64) (int, error) {
-    // Range/sanity checks.
-    if int(off) < 0 {
-        return 0, errors.New("Offset out of range (too small).")
-    }
-    if int(off)+len(dat) >= wb.m && wb.m > 0 {
-        return 0, errors.New("Offset+data length out of range (too large).")
-    }
-
-    // Check fast path extension
-    if int(off) == len(wb.d) {
-        wb.d = append(wb.d, dat...)
-        return len(dat), nil
-    }
-
-    // Check slower path extension
-    if int(off)+len(dat) >= len(wb.d) {
-        nd := make([]byte, int(off)+len(dat))
-        copy(nd, wb.d)
-        wb.d = nd
-    }
 
-    // Once no extension is needed just copy bytes into place.
-    copy(wb.d[int(off):], dat)
-    return len(dat), nil
+type dirPage struct {
+	
+	first   int64    // index of the first entry on the page
+	token   string   // continuation token that lists the page
 }
 
 
-
-
-
-
-
-
-// Cache
-type Node struct {
-	
-	Path    string
-	IsDir   bool
-	Size    int
-	fp      *bytes.Reader
-	mknod   *WriteBuffer
-}
+// Readdir offsets: "." is 1, ".." is 2, entry i is i+3
+const dirEntryOffset = 3
 
 
 type S3fs struct {
 	fuse.FileSystemBase
 	client *S3
-	nodes map[string]*Node
+	
+	cache    *MetaCache
+	root     *Node
+	
+	// attributes shared by all nodes, from the mount options
+	uid      uint32
+	gid      uint32
+	fileMode uint32
+	dirMode  uint32
+	
+	filelock sync.Mutex
+	files    map[uint64]*fileHandle
+	filefh   uint64
+	
+	dirlock sync.Mutex
+	dirs    map[uint64]*dirHandle
+	dirfh   uint64
+	
+	// background uploads still running, per node, and those that failed
+	uploadLock    sync.Mutex
+	uploads       map[*Node]int
+	failedUploads int64
 }
 
 
@@ -367,10 +509,32 @@ func (self *S3fs) Unlink(path string) (errc int) {
 
 	fmt.Printf("Unlink => %s\n", path)
 	
+	// handles still open on the file must not store it again on close
+	for _, file := range self.filesUnder(path) {
+		file.node.lock.Lock()
+		file.node.unlinked = true
+		file.node.lock.Unlock()
+
+		file.lock.Lock()
+		writer := file.writer
+		file.lock.Unlock()
+		if writer != nil {
+			writer.Unlink()
+		}
+	}
+	// nor an upload still running from an earlier close
+	if node, hit := self.cache.Get(path); hit && node != nil {
+		self.settle(node)
+	}
+	
 	err := self.client.Remove(path)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Println(path, err)
+		return fuseErrc(err)
 	}
+	self.cache.Drop(path)
+	self.cache.Miss(path)
+	self.cache.Changed(path)
 	return 0
 }
 
@@ -379,10 +543,43 @@ func (self *S3fs) Rmdir(path string) (errc int) {
 	
 	fmt.Printf("Rmdir => %s\n", path)
 	
-	err := self.client.Rmdir(path)
+	node, errc := self.lookup(path)
+	if errc != 0 {
+		return errc
+	}
+	if !node.IsDir {
+		return -fuse.ENOTDIR
+	}
+	
+	// files still uploading in it count
+	self.settleUnder(path)
+	empty, err := self.client.Empty(path)
 	if err != nil {
-		return 0
+		fmt.Println(path, err)
+		return fuseErrc(err)
+	}
+	
+	if !empty {
+		if !self.client.config.RecursiveRmdir {
+			return -fuse.ENOTEMPTY
+		}
+		// opt-in: take everything below along
+		err = self.client.RemoveTree(path)
+		if err != nil {
+			fmt.Println(path, err)
+			return fuseErrc(err)
+		}
+		self.cache.DropTree(path)
+	}
+	
+	// an implicit directory has no marker, deleting it anyway is harmless
+	err = self.client.Rmdir(path)
+	if err != nil {
+		fmt.Println(path, err)
+		return fuseErrc(err)
 	}	
+	self.cache.Miss(path)
+	self.cache.Changed(path)
 	
 	return 0
 }
@@ -392,16 +589,15 @@ func (self *S3fs) Mkdir(path string, mode uint32) (errc int) {
 
 	//fmt.Printf("Mkdir => %s\n", path)
 	
-	err := self.client.Mkdir(path, []byte(""))
+	meta := self.createMeta(fuse.S_IFDIR | mode)
+	err := self.client.Mkdir(path, []byte(""), meta)
 	if err != nil {
-		return
+		fmt.Println(path, err)
+		return fuseErrc(err)
 	}
 	
-	node := new(Node)
-	node.IsDir = true
-	node.Size = 0
-	node.Path = path	
-	self.nodes[path] = node
+	self.cache.Put(path, S3FileObject{IsDir: true, LastModified: time.Now(), Meta: &meta})
+	self.cache.Changed(path)
 
 	return
 }
@@ -409,23 +605,69 @@ func (self *S3fs) Mkdir(path string, mode uint32) (errc int) {
 
 func (self *S3fs) Mknod(path string, mode uint32, dev uint64) (errc int) {
 
-	// pre_write
-	// create file 
-	// then open
 	fmt.Printf("Mknod => %s\n", path)
 	
-	// 1000MB
-	sizeInMB := 10000 * 1024 * 1024
-	fp := NewWriteBuffer(0, sizeInMB)
+	// only regular files have an object form; a type of 0 means one
+	if kind := mode & fuse.S_IFMT; kind != 0 && kind != fuse.S_IFREG {
+		return -fuse.EPERM
+	}
 	
-	node := new(Node)
-	node.IsDir = false
-	node.Size = 0
-	node.Path = path	
-	node.mknod = fp
-	self.nodes[path] = node
+	_, errc = self.create(path, mode, true)
+	return errc
+}
 
-	return
+
+// Create makes and opens a new file, the open(2) O_CREAT case.
+func (self *S3fs) Create(path string, flags int, mode uint32) (errc int, fh uint64) {
+
+	excl := flags&fuse.O_EXCL != 0
+	node, errc := self.create(path, mode, excl)
+	if errc == -fuse.EEXIST && !excl {
+		// it exists after all, or was created meanwhile; open that
+		return self.Open(path, flags&^fuse.O_CREAT)
+	}
+	if errc != 0 {
+		return errc, ^uint64(0)
+	}
+	
+	return 0, self.openFile(node, flags)
+}
+
+
+// create stores the empty file now, so that it shows up in the bucket even
+// if nothing is written. It fails with EEXIST for an existing path, which
+// is checked in S3 itself unless the cache holds the node, since a cached
+// miss may be behind other clients. With excl, S3 is always asked. The
+// conditional PUT still guards against a file created in between.
+func (self *S3fs) create(path string, mode uint32, excl bool) (*Node, int) {
+
+	if node, hit := self.cache.Get(path); hit && node != nil && !excl {
+		return nil, -fuse.EEXIST
+	}
+	info, err := self.client.Stat(path)
+	if err == nil {
+		self.cache.Put(path, info)
+		return nil, -fuse.EEXIST
+	}
+	if errc := fuseErrc(err); errc != -fuse.ENOENT {
+		fmt.Println(path, err)
+		return nil, errc
+	}
+	
+	meta := self.createMeta(fuse.S_IFREG | mode&07777)
+	err = self.client.Create(path, meta)
+	if err != nil {
+		errc := fuseErrc(err)
+		if errc != -fuse.EEXIST {
+			fmt.Println(path, err)
+		}
+		return nil, errc
+	}
+	
+	node := self.cache.Put(path, S3FileObject{LastModified: time.Now(), Meta: &meta})
+	self.cache.Changed(path)
+
+	return node, 0
 }
 
 
@@ -434,95 +676,500 @@ func (self *S3fs) Write(path string, buff []byte, ofst int64, fh uint64) (n int)
 	//fmt.Printf("Write() %s\n", path)
 	//fmt.Printf("Write(?) %d\n", len(buff))
 
-	if node, found := self.nodes[path]; found {
+	file, found := self.getFile(fh)
+	if !found || file.flags&fuse.O_ACCMODE == fuse.O_RDONLY {
+		return -fuse.EBADF
+	}
 	
-		n, err := node.mknod.WriteAt(buff, ofst)
-		if nil != err {
-			//n = fuseErrc(err)
-			return 0
-		}
-		fmt.Printf("Written => %d \n", n)
-		
-		self.nodes[path].Size += n
+	writer, errc := self.writer(file, false)
+	if errc != 0 {
+		return errc
+	}
 
-		return n		
+	// the offset is the kernel's idea of the end, which another handle may
+	// have moved since
+	var err error
+	if file.flags&fuse.O_APPEND != 0 {
+		n, err = writer.Append(buff)
 	} else {
-		n = -fuse.EIO
-		return 0 
+		n, err = writer.WriteAt(buff, ofst)
+	}
+	if nil != err {
+		fmt.Println(path, err)
+		return fuseErrc(err)
+	}
+	
+	file.node.lock.Lock()
+	file.node.Size = int(writer.Size())
+	file.node.Mtime = time.Now()
+	file.node.Meta.Mtime = nil
+	file.node.lock.Unlock()
+
+	return n		
+}
+
+
+// Flush runs on every close() of the file. Unless writes are asynchronous,
+// it does not return before the data is stored, so that close() reports
+// upload failures.
+func (self *S3fs) Flush(path string, fh uint64) (errc int) {
+
+	file, found := self.getFile(fh)
+	if !found || self.client.config.AsyncWrites {
+		return 0
+	}
+
+	return self.sync(file)
+}
+
+
+// Fsync always waits until the data is stored, in either write mode.
+func (self *S3fs) Fsync(path string, datasync bool, fh uint64) (errc int) {
+
+	file, found := self.getFile(fh)
+	if !found {
+		return 0
+	}
+	
+	errc = self.settle(file.node)
+	if errc != 0 {
+		return errc
+	}
+
+	return self.sync(file)
+}
+
+
+func (self *S3fs) sync(file *fileHandle) (errc int) {
+
+	file.lock.Lock()
+	writer := file.writer
+	file.lock.Unlock()
+	
+	if writer == nil {
+		return 0
+	}
+	
+	err := writer.Sync()
+	if err != nil {
+		fmt.Println(file.node.path(), err)
+		return fuseErrc(err)
 	}
+	self.cache.Changed(file.node.path())
 
 	return 0
 }
 
 
-func (self *S3fs) Open(path string, flags int) (errc int, fh uint64) {
+// complete finishes the handle's writer on the last close. With async_writes
+// the upload carries on in the background, see settle.
+func (self *S3fs) complete(file *fileHandle) (errc int) {
+
+	node := file.node
+	writer := file.writer
+	file.writer = nil
 
-	fmt.Printf("Open() %s %+v\n", path, flags)
-	// use (Read) instead to init the open once instead of Open
+	if !self.client.config.AsyncWrites {
+		err := self.finish(node, writer.Close())
+		if err != nil {
+			fmt.Println(node.path(), err)
+			return fuseErrc(err)
+		}
+		self.cache.Changed(node.path())
+		return 0
+	}
 
-	return 0, 0
+	// uploads of one node are stored in the order they were closed
+	done := make(chan struct{})
+	node.lock.Lock()
+	prev := node.flushing
+	node.flushing = done
+	node.lock.Unlock()
+	self.uploadLock.Lock()
+	self.uploads[node]++
+	self.uploadLock.Unlock()
+
+	go func() {
+		if prev != nil {
+			<-prev
+		}
+		err := self.finish(node, writer.Close())
+		if err != nil {
+			fmt.Println(node.path(), err)
+			atomic.AddInt64(&self.failedUploads, 1)
+		}
+		self.cache.Changed(node.path())
+
+		node.lock.Lock()
+		if err != nil {
+			node.flushErr = err
+		}
+		node.lock.Unlock()
+
+		self.uploadLock.Lock()
+		if self.uploads[node]--; self.uploads[node] == 0 {
+			delete(self.uploads, node)
+		}
+		self.uploadLock.Unlock()
+		close(done)
+	}()
+
+	return 0
 }
 
 
-func (self *S3fs) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
+// settle waits for the background uploads of the node, and reports their
+// failure once.
+func (self *S3fs) settle(node *Node) (errc int) {
 
-	//fmt.Printf("Read() %s\n", path)
+	node.lock.Lock()
+	done := node.flushing
+	node.lock.Unlock()
+	
+	if done == nil {
+		return 0
+	}
+	<-done
 
-	if node, found := self.nodes[path]; found {
+	node.lock.Lock()
+	defer node.lock.Unlock()
 	
-		if node.fp == nil {
-			fp, err := self.client.Open(path)
-			if err != nil {
-				fmt.Println(err)
+	if node.flushing == done {
+		node.flushing = nil
+	}
+	err := node.flushErr
+	node.flushErr = nil
+	
+	return fuseErrc(err)
+}
+
+
+// settleAll waits for every background upload. Failures are left for the
+// handles and Destroy to report.
+func (self *S3fs) settleAll() {
+
+	self.settleWhere(func(node *Node) bool {
+		return true
+	})
+}
+
+
+// settleWhere waits for the background uploads of the nodes keep picks,
+// including those started meanwhile.
+func (self *S3fs) settleWhere(keep func(node *Node) bool) {
+
+	for {
+		self.uploadLock.Lock()
+		var nodes []*Node
+		for node := range self.uploads {
+			if keep(node) {
+				nodes = append(nodes, node)
 			}
-			self.nodes[path].fp = fp		
 		}
+		self.uploadLock.Unlock()
+
+		if len(nodes) == 0 {
+			return
+		}
+		for _, node := range nodes {
+			node.waitFlushed()
+		}
+	}
+}
+
+
+func (self *S3fs) Open(path string, flags int) (errc int, fh uint64) {
+
+	//fmt.Printf("Open() %s\n", path)
 	
-		n, err := node.fp.ReadAt(buff, ofst)
-		if nil != err {
-			//n = fuseErrc(err)
-			return 0
+	node, errc := self.lookup(path)
+	if errc != 0 {
+		return errc, ^uint64(0)
+	}
+	
+	writing := flags&fuse.O_ACCMODE != fuse.O_RDONLY
+	if node.IsDir && writing {
+		return -fuse.EISDIR, ^uint64(0)
+	}
+	
+	fh = self.openFile(node, flags)
+	
+	// O_TRUNC starts an empty file, stored on release even if nothing is
+	// written
+	if flags&fuse.O_TRUNC != 0 && writing && node.size() > 0 {
+		file, _ := self.getFile(fh)
+		_, errc := self.writer(file, true)
+		if errc != 0 {
+			self.closeFile(fh)
+			return errc, ^uint64(0)
 		}
+		
+		node.lock.Lock()
+		node.Size = 0
+		node.Mtime = time.Now()
+		node.Meta.Mtime = nil
+		node.lock.Unlock()
+	}
+	
+	return 0, fh
+}
 
-		return n		
-	} else {
-		n = -fuse.EIO
-		return 0 
+
+func (self *S3fs) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
+
+	//fmt.Printf("Read() %s\n", path)
+
+	file, found := self.getFile(fh)
+	if !found || file.flags&fuse.O_ACCMODE == fuse.O_WRONLY {
+		return -fuse.EBADF
+	}
+	
+	// read back this handle's own writes
+	file.lock.Lock()
+	writer := file.writer
+	file.lock.Unlock()
+	
+	if writer != nil {
+		n, err := writer.ReadAt(buff, ofst)
+		if err != ErrNotSequential {
+			if nil != err && io.EOF != err {
+				fmt.Println(path, err)
+				return fuseErrc(err)
+			}
+			return n
+		}
+		// streamed without a copy on disk, only the stored object is left
 	}
 
-	return 0
+	n, err := self.reader(file).ReadAt(buff, ofst)
+	if nil != err && io.EOF != err {
+		fmt.Println(path, err)
+		return fuseErrc(err)
+	}
+
+	return n		
 }
 
 
 func (self *S3fs) Opendir(path string) (errc int, fh uint64) {
 	//fmt.Printf("Opendir() %s\n", path)
-	return 0, 0
+	
+	self.dirlock.Lock()
+	defer self.dirlock.Unlock()
+	
+	self.dirfh++
+	self.dirs[self.dirfh] = &dirHandle{}
+	
+	return 0, self.dirfh
+}
+
+
+func (self *S3fs) Releasedir(path string, fh uint64) (errc int) {
+	
+	self.dirlock.Lock()
+	defer self.dirlock.Unlock()
+	
+	delete(self.dirs, fh)
+	return 0
 }
 
 
 func (self *S3fs) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
 
 	//fmt.Printf("Getattr() %s\n", path)
-	//fmt.Printf("%+v\n", self.nodes)
 	
 	if path == "/" {
-		stat.Mode = fuse.S_IFDIR | 0777
+		self.fillStat(self.root, stat)
 		return 0	
-	} else if node, found := self.nodes[path]; found {
+	}
+	
+	node, errc := self.lookup(path)
+	if errc != 0 {
+		return errc
+	}
 		
-		//fmt.Printf("got node %+v\n", node)
+	//fmt.Printf("got node %+v\n", node)
 	
-		if node.IsDir == true {
-			stat.Mode = fuse.S_IFDIR | 0777
-		} else {
-			stat.Mode = fuse.S_IFREG | 0777
-			stat.Size = int64(node.Size)	
+	self.fillStat(node, stat)
+
+	return 0		
+}
+
+
+// Chmod, Chown and Utimens store the attribute in the object's metadata,
+// which takes a copy of the object onto itself. While the file is being
+// written the change is kept on the node and stored after the upload.
+func (self *S3fs) Chmod(path string, mode uint32) (errc int) {
+
+	return self.setMeta(path, func(node *Node) {
+		kind := uint32(fuse.S_IFREG)
+		if node.IsDir {
+			kind = fuse.S_IFDIR
 		}
+		mode = kind | mode & 07777
+		node.Meta.Mode = &mode
+	})
+}
+
+
+func (self *S3fs) Chown(path string, uid uint32, gid uint32) (errc int) {
+
+	// -1 leaves an id as it is
+	return self.setMeta(path, func(node *Node) {
+		if uid != ^uint32(0) {
+			node.Meta.Uid = &uid
+		}
+		if gid != ^uint32(0) {
+			node.Meta.Gid = &gid
+		}
+	})
+}
+
+
+func (self *S3fs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
+
+	// only mtime is kept; tmsp[0] is atime
+	mtime := time.Now()
+	if len(tmsp) > 1 {
+		switch tmsp[1].Nsec {
+		case fuse.UTIME_OMIT:
+			return 0
+		case fuse.UTIME_NOW:
+		default:
+			mtime = tmsp[1].Time()
+		}
+	}
+
+	return self.setMeta(path, func(node *Node) {
+		node.Meta.Mtime = &mtime
+	})
+}
+
+
+// setMeta applies change to the node of path and stores the result.
+func (self *S3fs) setMeta(path string, change func(node *Node)) (errc int) {
+
+	// the mount point has no object to keep attributes in
+	if path == "/" {
+		self.root.lock.Lock()
+		change(self.root)
+		self.root.lock.Unlock()
+		return 0
+	}
+
+	node, errc := self.lookupMeta(path)
+	if errc != 0 {
+		return errc
+	}
+
+	node.lock.Lock()
+	change(node)
+	meta := node.Meta
+	busy := node.writers > 0
+	if busy {
+		node.metaDirty = true
+	}
+	node.lock.Unlock()
 
-		return 0		
+	if busy {
+		return 0
+	}
+
+	info, err := self.client.SetMeta(path, node.IsDir, meta)
+	if err != nil {
+		fmt.Println(path, err)
+		return fuseErrc(err)
+	}
+	info.Meta = &meta
+	self.cache.Put(path, info)
+	self.cache.Changed(path)
+
+	return 0
+}
+
+
+// finish ends a writer of the node, whose upload returned err. After the
+// last writer it stores the attributes changed in the meantime.
+func (self *S3fs) finish(node *Node, err error) error {
+
+	node.lock.Lock()
+	node.writers--
+	dirty := node.metaDirty && node.writers == 0 && !node.unlinked
+	if dirty {
+		node.metaDirty = false
+	}
+	meta := node.Meta
+	node.lock.Unlock()
+
+	if err != nil || !dirty {
+		return err
+	}
+
+	_, err = self.client.SetMeta(node.path(), node.IsDir, meta)
+	return err
+}
+
+
+// createMeta is the metadata of a new file or directory: its mode, and the
+// owner when that is not the mount's default owner.
+func (self *S3fs) createMeta(mode uint32) ObjectMeta {
+
+	meta := ObjectMeta{Mode: &mode}
+
+	uid, gid, _ := fuse.Getcontext()
+	if uid != self.uid && uid != ^uint32(0) {
+		meta.Uid = &uid
+	}
+	if gid != self.gid && gid != ^uint32(0) {
+		meta.Gid = &gid
+	}
+	return meta
+}
+
+
+// fillStat reports a node with the mount's owner and modes. S3 keeps a
+// single timestamp, the last modification, which stands in for all four;
+// directories without a marker object have none and show the mount time.
+func (self *S3fs) fillStat(node *Node, stat *fuse.Stat_t) {
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	
+	if node.IsDir == true {
+		stat.Mode = fuse.S_IFDIR | self.dirMode
+		stat.Nlink = 2
 	} else {
-		return -fuse.ENOENT
+		stat.Mode = fuse.S_IFREG | self.fileMode
+		stat.Nlink = 1
+		stat.Size = int64(node.Size)
+		stat.Blocks = (stat.Size + 511) / 512
 	}
+	stat.Uid = self.uid
+	stat.Gid = self.gid
+	stat.Blksize = 4096
+	
+	// attributes stored in the object win over the mount options
+	if node.Meta.Mode != nil {
+		stat.Mode = stat.Mode &^ 07777 | *node.Meta.Mode & 07777
+	}
+	if node.Meta.Uid != nil {
+		stat.Uid = *node.Meta.Uid
+	}
+	if node.Meta.Gid != nil {
+		stat.Gid = *node.Meta.Gid
+	}
+	
+	mtime := node.Mtime
+	if node.Meta.Mtime != nil {
+		mtime = *node.Meta.Mtime
+	}
+	if mtime.IsZero() {
+		mtime = self.root.Mtime
+	}
+	stat.Mtim = fuse.NewTimespec(mtime)
+	stat.Ctim = stat.Mtim
+	stat.Atim = stat.Mtim
+	stat.Birthtim = stat.Mtim
 }
 
 
@@ -532,39 +1179,114 @@ func (self *S3fs) Readdir(path string,
 	fh uint64) (errc int) {
 	
 	
-	fill(".", nil, 0)
-	fill("..", nil, 0)
+	if ofst < 1 && !fill(".", nil, 1) {
+		return 0
+	}
+	if ofst < 2 && !fill("..", nil, 2) {
+		return 0
+	}
 	
+	self.dirlock.Lock()
+	dir, found := self.dirs[fh]
+	self.dirlock.Unlock()
+	if !found {
+		dir = &dirHandle{}
+	}
 	
-	entries, err := self.client.ReadDir(path)
-	if err != nil {
-		fmt.Println(err)
-	} else {
+	// resume from the page holding the next entry
+	next := ofst - dirEntryOffset + 1
+	if next < 0 {
+		next = 0
+	}
+	
+	// a cached listing is taken once per handle, so offsets stay stable
+	if next == 0 && dir.pages == nil {
+		dir.cached, _ = self.cache.Listing(path)
+	}
+	if dir.cached != nil {
+		for index := next; index < int64(len(dir.cached)); index++ {
+			entry := dir.cached[index]
+			node := self.cache.Offer(self.child(path, entry.Name), entry)
+			if !fill(entry.Name, self.entryStat(node), index + dirEntryOffset) {
+				return 0
+			}
+		}
+		return 0
+	}
+	
+	page := dirPage{}
+	for _, p := range dir.pages {
+		if p.first <= next {
+			page = p
+		}
+	}
 	
-		//self.updateInodes(path, entries)
 	
-		for _, entry := range entries {
+	for {
+		entries, token, err := self.client.ReadDirPage(path, page.token)
+		if err != nil {
+			fmt.Println(path, err)
+			return fuseErrc(err)
+		}
+		
+		// collect a listing read from the start for the cache
+		if !dir.partial && page.first == int64(len(dir.listed)) {
+			dir.listed = append(dir.listed, entries...)
+			if token == "" {
+				self.cache.PutListing(path, dir.listed)
+			}
+		}
+		if page.first > int64(len(dir.listed)) || len(dir.listed) >= self.cache.size {
+			dir.partial = true
+			dir.listed = nil
+		}
 		
-			fill(entry.Name, nil, 0)
+		for i, entry := range entries {
 			
-			// add node to Cache for Getattr()
-			node := new(Node)
-			node.IsDir = entry.IsDir
-			node.Size = int(entry.Size)
-			if path == "/" {
-				node.Path = path + entry.Name
-			} else {
-				node.Path = path + "/" + entry.Name
+			index := page.first + int64(i)
+			if index < next {
+				continue
 			}
 			
-			//fmt.Printf("%+v\n", node)
+			// add node to Cache for Getattr()
+			node := self.cache.Put(self.child(path, entry.Name), entry)
 			
-			self.nodes[node.Path] = node
+			if !fill(entry.Name, self.entryStat(node), index + dirEntryOffset) {
+				return 0
+			}
+		}
+		
+		if token == "" {
+			return 0
+		}
+		
+		page = dirPage{first: page.first + int64(len(entries)), token: token}
+		if n := len(dir.pages); n == 0 || dir.pages[n-1].first < page.first {
+			dir.pages = append(dir.pages, page)
 		}
 	}
-	
+}
 
-	return 0
+
+// entryStat is the stat handed to the kernel with a directory entry, so
+// that ls -l needs no Getattr per entry. Listings carry size and mtime;
+// stored modes and owners are only known for entries that were looked up,
+// the others show the mount defaults.
+func (self *S3fs) entryStat(node *Node) *fuse.Stat_t {
+
+	stat := &fuse.Stat_t{}
+	self.fillStat(node, stat)
+	return stat
+}
+
+
+// child joins a directory path and an entry name.
+func (self *S3fs) child(dir string, name string) string {
+
+	if dir == "/" {
+		return dir + name
+	}
+	return dir + "/" + name
 }
 
 
@@ -572,24 +1294,40 @@ func (self *S3fs) Release(path string, fh uint64) (errc int) {
 	
 	fmt.Printf("Release() %s\n", path)
 	
-	if node, found := self.nodes[path]; found {
-
-		if len(node.mknod.d) > 0 {
-		
-			fmt.Printf("[+] s3 Creating file \n")
-			err := self.client.Create(path, node.mknod.d)
-			if err != nil {
-				fmt.Println(err)
-			} 
-		} else {
-			self.nodes[path].fp = nil
-		}	
-	}	
+	file, found := self.closeFile(fh)
+	if !found {
+		return 0
+	}
+	
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	
+	if ra, ok := file.ra.(*ReadAhead); ok {
+		ra.Close()
+	}
+	file.fp = nil
+	file.ra = nil
+	
+	if file.writer != nil {
+		return self.complete(file)
+	}
 	
 	return 0
 }
 
 
+// Destroy runs at unmount; background uploads are waited for.
+func (self *S3fs) Destroy() {
+
+	fmt.Println("unmounting", self.client.config.Mountpoint)
+	self.settleAll()
+	fmt.Println("S3:", self.client.stats)
+	if n := atomic.LoadInt64(&self.failedUploads); n > 0 {
+		fmt.Println(n, "background uploads failed")
+	}
+}
+
+
 func (self *S3fs) Statfs(path string, stat *fuse.Statfs_t) (err int) {
 	
 	//fmt.Printf("STAT FS!!! %s\n", path)
@@ -617,30 +1355,61 @@ func (self *S3fs) Statfs(path string, stat *fuse.Statfs_t) (err int) {
 }
 
 
-func main() {
+// NewS3fs sets up the file system on client, ready to mount or to be
+// driven directly, see Harness.
+func NewS3fs(client *S3, config S3Config) (*S3fs, error) {
 
+	var err error
 	s3fs := &S3fs{}
 	
-	config := S3Config{}
-	config.SecretAccessKey = "SecretAccessKey"
-	config.AccessKeyId = "AccessKeyId"
-	config.Region = "us-west-2"
-
-	s3, err := NewClient("swift2", config)
+	s3fs.client = client
+	s3fs.cache = NewMetaCache(config)
+	s3fs.root = &Node{Path: "/", IsDir: true, Mtime: time.Now()}
+	s3fs.uid, s3fs.gid, err = config.Owner()
 	if err != nil {
-		fmt.Println("unable to create aws session")
+		return nil, err
 	}
+	s3fs.fileMode, s3fs.dirMode = config.Modes()
+	s3fs.files = make(map[uint64]*fileHandle)
+	s3fs.dirs = make(map[uint64]*dirHandle)
+	s3fs.uploads = make(map[*Node]int)
 	
+	return s3fs, nil
+}
+
+
+func main() {
+
+	config, args, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	s3, err := NewClient(config.Bucket, config)
+	if err != nil {
+		fmt.Println("unable to create aws session:", err)
+		os.Exit(1)
+	}
 	
-	// init
-	s3fs.client = s3
-	s3fs.nodes = make(map[string]*Node)
+	s3fs, err := NewS3fs(s3, config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
 	
 	
 	host := fuse.NewFileSystemHost(s3fs)
 	host.SetCapReaddirPlus(true)
-	host.Mount("", append([]string{
-		"-o", "ExactFileSystemName=NTFS",
-		"-o", fmt.Sprintf("volname=%s", "S3"),
-	}, os.Args[1:]...))	
+	
+	// cgofuse unmounts on SIGINT and SIGTERM; Destroy waits for the uploads
+	if !host.Mount(config.Mountpoint, append(MountOptions(config), args...)) {
+		fmt.Println("unable to mount", config.Mountpoint)
+		os.Exit(1)
+	}
+	
+	// data that never reached the bucket
+	if atomic.LoadInt64(&s3fs.failedUploads) > 0 {
+		os.Exit(1)
+	}
 }
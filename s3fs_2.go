@@ -1,3 +1,8 @@
+//go:build ignore
+// +build ignore
+
+// Abandoned sshfs/afero experiment, kept for reference; it does not build.
+
 /*
  * s3fs-fuse.go
  * Windows FUSE-based file system backed by Amazon S3
@@ -0,0 +1,1121 @@
+/*
+ * s3fs_test.go
+ * The file system callbacks on MemStore and through the fake S3 server
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// testCase is one test run on one backend. fake is nil on the memory
+// backend.
+type testCase struct {
+
+	h      *Harness
+	client *S3
+	config S3Config
+	mem    *MemStore
+	fake   *FakeS3
+}
+
+
+type testBackend struct {
+
+	name string
+	open func(mem *MemStore, config S3Config) (*S3, *FakeS3, error)
+}
+
+
+var testBackends = []testBackend{
+	{"memory", func(mem *MemStore, config S3Config) (*S3, *FakeS3, error) {
+		return NewS3(mem, config), nil, nil
+	}},
+	{"http", func(mem *MemStore, config S3Config) (*S3, *FakeS3, error) {
+		fake, err := StartFakeS3(mem, config.Bucket)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.Endpoint = fake.URL()
+		client, err := NewClient(config.Bucket, config)
+		if err != nil {
+			fake.Close()
+			return nil, nil, err
+		}
+		return client, fake, nil
+	}},
+}
+
+
+// testConfig keeps parts and listing pages small so that the tests cross
+// their boundaries, and retries short.
+func testConfig() S3Config {
+
+	return S3Config{
+		Bucket:          "test",
+		AccessKeyId:     "test",
+		SecretAccessKey: "test",
+		PartSize:        minPartSize,
+		ListPageSize:    3,
+		RetryBaseDelay:  time.Millisecond,
+		RetryMaxDelay:   20 * time.Millisecond,
+		RequestTimeout:  500 * time.Millisecond,
+	}
+}
+
+
+// runBackends runs check on MemStore directly and through the fake S3
+// server, one subtest each; with http set, only through the server.
+func runBackends(t *testing.T, http bool, check func(c *testCase) error) {
+
+	runBackendsWith(t, http, nil, check)
+}
+
+
+// runBackendsWith is runBackends with adjust applied to the config first.
+func runBackendsWith(t *testing.T, http bool, adjust func(config *S3Config), check func(c *testCase) error) {
+
+	for _, backend := range testBackends {
+		if http && backend.name != "http" {
+			continue
+		}
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			err := runBackend(backend, adjust, check)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+
+func runBackend(backend testBackend, adjust func(config *S3Config), check func(c *testCase) error) error {
+
+	mem := NewMemStore()
+	config := testConfig()
+	if adjust != nil {
+		adjust(&config)
+	}
+
+	client, fake, err := backend.open(mem, config)
+	if err != nil {
+		return err
+	}
+	if fake != nil {
+		defer fake.Close()
+	}
+
+	h, err := NewHarness(client, config)
+	if err != nil {
+		return err
+	}
+
+	err = check(&testCase{h: h, client: client, config: config, mem: mem, fake: fake})
+	h.Destroy()
+	if err == nil && mem.Uploads() != 0 {
+		err = fmt.Errorf("%d multipart uploads left behind", mem.Uploads())
+	}
+	return err
+}
+
+
+// fresh is a second view of the same bucket with an empty cache, to check
+// what was stored rather than what was cached.
+func (self *testCase) fresh() (*Harness, error) {
+
+	return NewHarness(self.client, self.config)
+}
+
+
+// pattern returns n bytes that differ at every offset within a part.
+func pattern(n int) []byte {
+
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i>>12)
+	}
+	return data
+}
+
+
+func expectErrno(err error, errno int, what string) error {
+
+	if !isErrno(err, errno) {
+		return fmt.Errorf("%s: got %v, want %v", what, err, fuse.Error(errno))
+	}
+	return nil
+}
+
+
+func expectFile(h *Harness, path string, want []byte) error {
+
+	got, err := h.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read %s: %v", path, err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("read %s: %d bytes differ from the %d expected", path, len(got), len(want))
+	}
+	stat, err := h.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat %s: %v", path, err)
+	}
+	if stat.Size != int64(len(want)) {
+		return fmt.Errorf("stat %s: size %d, want %d", path, stat.Size, len(want))
+	}
+	return nil
+}
+
+
+func TestWriteRead(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		err := c.h.WriteFile("/a.txt", []byte("hello"))
+		if err != nil {
+			return err
+		}
+		stat, err := c.h.Stat("/a.txt")
+		if err != nil {
+			return err
+		}
+		if stat.Mode&fuse.S_IFMT != fuse.S_IFREG {
+			return fmt.Errorf("mode %o is not a regular file", stat.Mode)
+		}
+		fresh, err := c.fresh()
+		if err != nil {
+			return err
+		}
+		return expectFile(fresh, "/a.txt", []byte("hello"))
+	})
+}
+
+
+func TestCreateEmpty(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		fh, err := c.h.Create("/empty", fuse.O_WRONLY|fuse.O_CREAT, 0644)
+		if err != nil {
+			return err
+		}
+		// the object exists before anything is written
+		_, err = c.mem.Head("empty")
+		if err != nil {
+			return fmt.Errorf("not in the bucket after create: %v", err)
+		}
+		return c.h.Close("/empty", fh)
+	})
+}
+
+
+func TestCreateExcl(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		err := c.h.WriteFile("/x", []byte("x"))
+		if err != nil {
+			return err
+		}
+		_, err = c.h.Create("/x", fuse.O_WRONLY|fuse.O_CREAT|fuse.O_EXCL, 0644)
+		if err := expectErrno(err, fuse.EEXIST, "O_EXCL on an existing file"); err != nil {
+			return err
+		}
+		fh, err := c.h.Create("/y", fuse.O_WRONLY|fuse.O_CREAT|fuse.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		return c.h.Close("/y", fh)
+	})
+}
+
+
+
+// unconditionalStore is a server without conditional PUTs.
+type unconditionalStore struct {
+
+	ObjectStore
+}
+
+
+func (self *unconditionalStore) Put(key string, body io.ReadSeeker, opts PutOptions) (ObjectInfo, error) {
+
+	opts.IfNoneMatch = false
+	return self.ObjectStore.Put(key, body, opts)
+}
+
+
+// open(O_CREAT) of a file another client made after a cached miss opens it
+// rather than replacing it, even where the server ignores If-None-Match
+func TestCreateExisting(t *testing.T) {
+
+	mem := NewMemStore()
+	config := testConfig()
+	h, err := NewHarness(NewS3(&unconditionalStore{mem}, config), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy()
+
+	_, err = h.Stat("/x")
+	if err := expectErrno(err, fuse.ENOENT, "stat before the file exists"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = mem.Put("x", bytes.NewReader([]byte("other")), PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err := h.Create("/x", fuse.O_WRONLY|fuse.O_CREAT, 0644)
+	if err == nil {
+		err = h.Close("/x", fh)
+	}
+	if err == nil {
+		err = expectFile(h, "/x", []byte("other"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		err := c.h.WriteFile("/log", []byte("one\n"))
+		if err != nil {
+			return err
+		}
+		fh, err := c.h.Open("/log", fuse.O_WRONLY|fuse.O_APPEND)
+		if err != nil {
+			return err
+		}
+		// the offset is ignored with O_APPEND
+		err = c.h.Write("/log", fh, []byte("two\n"), 0)
+		if err != nil {
+			return err
+		}
+		err = c.h.Close("/log", fh)
+		if err != nil {
+			return err
+		}
+		return expectFile(c.h, "/log", []byte("one\ntwo\n"))
+	})
+}
+
+
+func TestAccessMode(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		err := c.h.WriteFile("/ro", []byte("data"))
+		if err != nil {
+			return err
+		}
+		fh, err := c.h.Open("/ro", fuse.O_RDONLY)
+		if err != nil {
+			return err
+		}
+		err = c.h.Write("/ro", fh, []byte("x"), 0)
+		c.h.Close("/ro", fh)
+		if err := expectErrno(err, fuse.EBADF, "write on O_RDONLY"); err != nil {
+			return err
+		}
+		fh, err = c.h.Open("/ro", fuse.O_WRONLY)
+		if err != nil {
+			return err
+		}
+		_, err = c.h.Read("/ro", fh, 4, 0)
+		c.h.Close("/ro", fh)
+		return expectErrno(err, fuse.EBADF, "read on O_WRONLY")
+	})
+}
+
+
+func TestRandomWrite(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		fh, err := c.h.Create("/r", fuse.O_RDWR|fuse.O_CREAT, 0644)
+		if err != nil {
+			return err
+		}
+		for _, w := range []struct {
+			off  int64
+			data string
+		}{{6, "world"}, {0, "hello "}, {20, "!"}} {
+			err = c.h.Write("/r", fh, []byte(w.data), w.off)
+			if err != nil {
+				return err
+			}
+		}
+		// read back through the same handle before it is stored
+		got, err := c.h.Read("/r", fh, 64, 0)
+		if err != nil {
+			return err
+		}
+		want := []byte("hello world\x00\x00\x00\x00\x00\x00\x00\x00\x00!")
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("read back %q, want %q", got, want)
+		}
+		err = c.h.Close("/r", fh)
+		if err != nil {
+			return err
+		}
+		return expectFile(c.h, "/r", want)
+	})
+}
+
+
+func TestMultipart(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		data := pattern(3*minPartSize + 12345)
+		err := c.h.WriteFile("/big", data)
+		if err != nil {
+			return err
+		}
+		info, err := c.mem.Head("big")
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains([]byte(info.ETag), []byte("-")) {
+			return fmt.Errorf("ETag %s is not from a multipart upload", info.ETag)
+		}
+
+		fh, err := c.h.Open("/big", fuse.O_RDONLY)
+		if err != nil {
+			return err
+		}
+		off := int64(2*minPartSize - 100)
+		got, err := c.h.Read("/big", fh, 4096, off)
+		c.h.Close("/big", fh)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, data[off:off+4096]) {
+			return fmt.Errorf("ranged read across a part boundary differs")
+		}
+		return expectFile(c.h, "/big", data)
+	})
+}
+
+
+func TestReaddir(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		err := c.h.Mkdir("/d", 0755)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 7; i++ {
+			err = c.h.WriteFile(fmt.Sprintf("/d/f%d", i), make([]byte, i))
+			if err != nil {
+				return err
+			}
+		}
+		err = c.h.Mkdir("/d/sub", 0755)
+		if err != nil {
+			return err
+		}
+
+		// a fresh cache lists from the store, several pages of 3
+		fresh, err := c.fresh()
+		if err != nil {
+			return err
+		}
+		entries, err := fresh.ReadDir("/d")
+		if err != nil {
+			return err
+		}
+		if len(entries) != 8 {
+			return fmt.Errorf("%d entries, want 8", len(entries))
+		}
+		for i, entry := range entries[:7] {
+			if entry.Name != fmt.Sprintf("f%d", i) {
+				return fmt.Errorf("entry %d is %s", i, entry.Name)
+			}
+			if entry.Stat == nil || entry.Stat.Size != int64(i) || entry.Stat.Mode&fuse.S_IFMT != fuse.S_IFREG {
+				return fmt.Errorf("%s: stat %+v", entry.Name, entry.Stat)
+			}
+		}
+		sub := entries[7]
+		if sub.Name != "sub" || sub.Stat == nil || sub.Stat.Mode&fuse.S_IFMT != fuse.S_IFDIR {
+			return fmt.Errorf("%s: stat %+v", sub.Name, sub.Stat)
+		}
+		return nil
+	})
+}
+
+
+
+// stat of what a listing returned is answered without asking S3 again
+func TestReaddirStat(t *testing.T) {
+
+	runBackends(t, true, func(c *testCase) error {
+		err := c.h.Mkdir("/d", 0755)
+		if err == nil {
+			err = c.h.Mkdir("/d/sub", 0755)
+		}
+		for i := 0; i < 5 && err == nil; i++ {
+			err = c.h.WriteFile(fmt.Sprintf("/d/f%d", i), make([]byte, i))
+		}
+		if err != nil {
+			return err
+		}
+
+		fresh, err := c.fresh()
+		if err != nil {
+			return err
+		}
+		entries, err := fresh.ReadDir("/d")
+		if err != nil {
+			return err
+		}
+		listed := c.fake.Requests()
+		for _, entry := range entries {
+			stat, err := fresh.Stat("/d/" + entry.Name)
+			if err != nil {
+				return err
+			}
+			if stat.Mode != entry.Stat.Mode || stat.Size != entry.Stat.Size || stat.Mtim != entry.Stat.Mtim {
+				return fmt.Errorf("%s: stat %+v differs from the listing's %+v", entry.Name, stat, entry.Stat)
+			}
+		}
+		if n := c.fake.Requests() - listed; n != 0 {
+			return fmt.Errorf("%d requests for the stat of %d listed entries", n, len(entries))
+		}
+		return nil
+	})
+}
+
+func TestRmdir(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		err := c.h.Mkdir("/d", 0755)
+		if err != nil {
+			return err
+		}
+		err = c.h.WriteFile("/d/f", []byte("f"))
+		if err != nil {
+			return err
+		}
+		if err := expectErrno(c.h.Rmdir("/d"), fuse.ENOTEMPTY, "rmdir of a non-empty directory"); err != nil {
+			return err
+		}
+		if err := expectErrno(c.h.Rmdir("/d/f"), fuse.ENOTDIR, "rmdir of a file"); err != nil {
+			return err
+		}
+		err = c.h.Unlink("/d/f")
+		if err != nil {
+			return err
+		}
+		err = c.h.Rmdir("/d")
+		if err != nil {
+			return err
+		}
+		_, err = c.h.Stat("/d")
+		return expectErrno(err, fuse.ENOENT, "stat after rmdir")
+	})
+}
+
+
+
+// heldStore holds the uploads of contents until release is closed; empty
+// objects go through.
+type heldStore struct {
+
+	ObjectStore
+	release chan struct{}
+}
+
+
+func (self *heldStore) Put(key string, body io.ReadSeeker, opts PutOptions) (ObjectInfo, error) {
+
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if size > 0 {
+		<-self.release
+	}
+	body.Seek(0, io.SeekStart)
+	return self.ObjectStore.Put(key, body, opts)
+}
+
+
+// rmdir waits for the files still uploading in the directory, which keep it
+// from being removed
+func TestRmdirAsync(t *testing.T) {
+
+	mem := NewMemStore()
+	store := &heldStore{ObjectStore: mem, release: make(chan struct{})}
+	config := testConfig()
+	config.AsyncWrites = true
+	h, err := NewHarness(NewS3(store, config), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := func() {
+		select {
+		case <-store.release:
+		default:
+			close(store.release)
+		}
+	}
+	defer h.Destroy()
+	defer release()
+
+	err = h.Mkdir("/d", 0755)
+	if err == nil {
+		err = h.Mkdir("/e", 0755)
+	}
+	if err == nil {
+		err = h.WriteFile("/d/f", []byte("f"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other directories do not wait
+	err = h.Rmdir("/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Rmdir("/d")
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("rmdir returned %v during the upload", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	err = expectErrno(<-done, fuse.ENOTEMPTY, "rmdir after the upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+
+func TestUnlink(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		err := c.h.WriteFile("/gone", []byte("gone"))
+		if err != nil {
+			return err
+		}
+		err = c.h.Unlink("/gone")
+		if err != nil {
+			return err
+		}
+		_, err = c.h.ReadFile("/gone")
+		if err := expectErrno(err, fuse.ENOENT, "open after unlink"); err != nil {
+			return err
+		}
+		_, err = c.mem.Head("gone")
+		if err == nil {
+			return fmt.Errorf("still in the bucket")
+		}
+		return nil
+	})
+}
+
+
+// a file unlinked while open is still written and read through its handle,
+// and never stored
+func TestUnlinkOpen(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		fh, err := c.h.Create("/f", fuse.O_RDWR|fuse.O_CREAT, 0644)
+		if err != nil {
+			return err
+		}
+		err = c.h.Write("/f", fh, []byte("hello"), 0)
+		if err == nil {
+			err = c.h.Unlink("/f")
+		}
+		if err == nil {
+			err = c.h.Write("/f", fh, []byte(" world"), 5)
+		}
+		var got []byte
+		if err == nil {
+			got, err = c.h.Read("/f", fh, 64, 0)
+		}
+		if cerr := c.h.Close("/f", fh); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if string(got) != "hello world" {
+			return fmt.Errorf("read %q through the handle", got)
+		}
+		_, err = c.mem.Head("f")
+		if err == nil {
+			return fmt.Errorf("stored on close")
+		}
+		_, err = c.h.Stat("/f")
+		return expectErrno(err, fuse.ENOENT, "stat after unlink")
+	})
+}
+
+
+// background uploads started while a recursive rmdir waits for others all
+// land
+func TestAsyncUploads(t *testing.T) {
+
+	async := func(config *S3Config) {
+		config.AsyncWrites = true
+		config.RecursiveRmdir = true
+	}
+	runBackendsWith(t, false, async, func(c *testCase) error {
+		err := c.h.Mkdir("/d", 0755)
+		if err == nil {
+			err = c.h.Mkdir("/e", 0755)
+		}
+		if err != nil {
+			return err
+		}
+
+		const n = 20
+		errs := make(chan error, 2)
+		go func() {
+			for i := 0; i < n; i++ {
+				err := c.h.WriteFile(fmt.Sprintf("/d/f%d", i), pattern(1000+i))
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+		go func() {
+			for i := 0; i < n; i++ {
+				err := c.h.Mkdir("/e/sub", 0755)
+				if err == nil {
+					err = c.h.WriteFile("/e/sub/x", []byte("x"))
+				}
+				if err == nil {
+					err = c.h.Rmdir("/e/sub")
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				return err
+			}
+		}
+
+		c.h.Destroy()
+		for i := 0; i < n; i++ {
+			info, err := c.mem.Head(fmt.Sprintf("d/f%d", i))
+			if err != nil {
+				return err
+			}
+			if info.Size != int64(1000+i) {
+				return fmt.Errorf("%s: %d bytes stored, want %d", info.Key, info.Size, 1000+i)
+			}
+		}
+		return nil
+	})
+}
+
+func TestRenameFile(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		err := c.h.WriteFile("/a", []byte("a"))
+		if err == nil {
+			err = c.h.WriteFile("/b", []byte("b"))
+		}
+		if err == nil {
+			err = c.h.Rename("/a", "/c", 0)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = c.h.Stat("/a")
+		if err := expectErrno(err, fuse.ENOENT, "stat of the old name"); err != nil {
+			return err
+		}
+		if err := expectFile(c.h, "/c", []byte("a")); err != nil {
+			return err
+		}
+		err = c.h.Rename("/c", "/b", fuse.RENAME_NOREPLACE)
+		if err := expectErrno(err, fuse.EEXIST, "RENAME_NOREPLACE onto a file"); err != nil {
+			return err
+		}
+		err = c.h.Rename("/c", "/b", fuse.RENAME_EXCHANGE)
+		if err != nil {
+			return err
+		}
+		if err := expectFile(c.h, "/b", []byte("a")); err != nil {
+			return err
+		}
+		return expectFile(c.h, "/c", []byte("b"))
+	})
+}
+
+
+func TestRenameDir(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		err := c.h.Mkdir("/src", 0755)
+		if err == nil {
+			err = c.h.Mkdir("/src/sub", 0755)
+		}
+		if err == nil {
+			err = c.h.WriteFile("/src/x", []byte("x"))
+		}
+		if err == nil {
+			err = c.h.WriteFile("/src/sub/y", []byte("y"))
+		}
+		if err == nil {
+			err = c.h.Rename("/src", "/dst", 0)
+		}
+		if err != nil {
+			return err
+		}
+		if err := expectErrno(c.h.Rename("/dst", "/dst/sub/in", 0), fuse.EINVAL, "rename into itself"); err != nil {
+			return err
+		}
+
+		fresh, err := c.fresh()
+		if err != nil {
+			return err
+		}
+		_, err = fresh.Stat("/src")
+		if err := expectErrno(err, fuse.ENOENT, "stat of the old directory"); err != nil {
+			return err
+		}
+		if err := expectFile(fresh, "/dst/x", []byte("x")); err != nil {
+			return err
+		}
+		return expectFile(fresh, "/dst/sub/y", []byte("y"))
+	})
+}
+
+
+
+// a directory moves with the background uploads still running in it
+func TestRenameDirAsync(t *testing.T) {
+
+	async := func(config *S3Config) {
+		config.AsyncWrites = true
+	}
+	runBackendsWith(t, false, async, func(c *testCase) error {
+		err := c.h.Mkdir("/src", 0755)
+		for i := 0; i < 5 && err == nil; i++ {
+			err = c.h.WriteFile(fmt.Sprintf("/src/f%d", i), pattern(1000+i))
+		}
+		if err == nil {
+			err = c.h.Rename("/src", "/dst", 0)
+		}
+		if err != nil {
+			return err
+		}
+
+		fresh, err := c.fresh()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 5; i++ {
+			err := expectFile(fresh, fmt.Sprintf("/dst/f%d", i), pattern(1000+i))
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fresh.Stat("/src")
+		return expectErrno(err, fuse.ENOENT, "stat of the old directory")
+	})
+}
+
+func TestRenameOpen(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		fh, err := c.h.Create("/w", fuse.O_WRONLY|fuse.O_CREAT, 0644)
+		if err != nil {
+			return err
+		}
+		err = c.h.Write("/w", fh, []byte("abc"), 0)
+		if err == nil {
+			err = c.h.Rename("/w", "/w2", 0)
+		}
+		if err == nil {
+			// the handle follows the file to its new name
+			err = c.h.Write("/w2", fh, []byte("def"), 3)
+		}
+		if cerr := c.h.Close("/w2", fh); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		_, err = c.mem.Head("w")
+		if err == nil {
+			return fmt.Errorf("old name still in the bucket")
+		}
+		return expectFile(c.h, "/w2", []byte("abcdef"))
+	})
+}
+
+
+func TestTruncate(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		err := c.h.WriteFile("/t", []byte("0123456789"))
+		if err != nil {
+			return err
+		}
+		for _, step := range []struct {
+			size int64
+			want string
+		}{{4, "0123"}, {8, "0123\x00\x00\x00\x00"}, {0, ""}} {
+			err = c.h.Truncate("/t", step.size, ^uint64(0))
+			if err != nil {
+				return err
+			}
+			if err := expectFile(c.h, "/t", []byte(step.want)); err != nil {
+				return err
+			}
+		}
+
+		// ftruncate of a file being written
+		fh, err := c.h.Open("/t", fuse.O_RDWR)
+		if err != nil {
+			return err
+		}
+		err = c.h.Write("/t", fh, []byte("abcdef"), 0)
+		if err == nil {
+			err = c.h.Truncate("/t", 3, fh)
+		}
+		if cerr := c.h.Close("/t", fh); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		return expectFile(c.h, "/t", []byte("abc"))
+	})
+}
+
+
+func TestTruncateLarge(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		data := pattern(3 * minPartSize)
+		err := c.h.WriteFile("/big", data)
+		if err != nil {
+			return err
+		}
+		// both sides of the copy are multipart
+		shrink := int64(2*minPartSize + 1)
+		err = c.h.Truncate("/big", shrink, ^uint64(0))
+		if err != nil {
+			return err
+		}
+		if err := expectFile(c.h, "/big", data[:shrink]); err != nil {
+			return err
+		}
+		grow := 4*minPartSize + 7
+		err = c.h.Truncate("/big", int64(grow), ^uint64(0))
+		if err != nil {
+			return err
+		}
+		want := append(append([]byte{}, data[:shrink]...), make([]byte, grow-int(shrink))...)
+		return expectFile(c.h, "/big", want)
+	})
+}
+
+
+func TestAttributes(t *testing.T) {
+
+	runBackends(t, false, func(c *testCase) error {
+		err := c.h.WriteFile("/m", []byte("m"))
+		if err == nil {
+			err = c.h.Mkdir("/dir", 0755)
+		}
+		if err != nil {
+			return err
+		}
+		mtime := time.Date(2020, 2, 2, 12, 0, 0, 0, time.UTC)
+		for _, path := range []string{"/m", "/dir"} {
+			err = c.h.Chmod(path, 0640)
+			if err == nil {
+				err = c.h.Chown(path, 4242, 4343)
+			}
+			if err == nil {
+				err = c.h.Utimens(path, mtime)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		fresh, err := c.fresh()
+		if err != nil {
+			return err
+		}
+		for _, path := range []string{"/m", "/dir"} {
+			stat, err := fresh.Stat(path)
+			if err != nil {
+				return err
+			}
+			if stat.Mode&07777 != 0640 || stat.Uid != 4242 || stat.Gid != 4343 || stat.Mtim.Sec != mtime.Unix() {
+				return fmt.Errorf("%s: mode %o, owner %d:%d, mtime %d", path, stat.Mode, stat.Uid, stat.Gid, stat.Mtim.Sec)
+			}
+		}
+		// attributes survive a rewrite of the contents
+		err = fresh.WriteFile("/m", []byte("new"))
+		if err != nil {
+			return err
+		}
+		fresh, err = c.fresh()
+		if err != nil {
+			return err
+		}
+		stat, err := fresh.Stat("/m")
+		if err != nil {
+			return err
+		}
+		if stat.Mode&07777 != 0640 || stat.Uid != 4242 {
+			return fmt.Errorf("after a write: mode %o, uid %d", stat.Mode, stat.Uid)
+		}
+
+		// a node known from a listing reads its attributes before storing
+		// them again
+		fresh, err = c.fresh()
+		if err == nil {
+			_, err = fresh.ReadDir("/")
+		}
+		if err == nil {
+			err = fresh.Chmod("/m", 0600)
+		}
+		if err == nil {
+			fresh, err = c.fresh()
+		}
+		if err != nil {
+			return err
+		}
+		stat, err = fresh.Stat("/m")
+		if err != nil {
+			return err
+		}
+		if stat.Mode&07777 != 0600 || stat.Uid != 4242 {
+			return fmt.Errorf("after a listed chmod: mode %o, uid %d", stat.Mode, stat.Uid)
+		}
+		return nil
+	})
+}
+
+
+func TestRetry(t *testing.T) {
+
+	runBackends(t, true, func(c *testCase) error {
+		c.fake.Fail(2, "SlowDown", 503, 0)
+		err := c.h.WriteFile("/r", []byte("retried"))
+		if err != nil {
+			return err
+		}
+		// a stalled answer times out and is tried again
+		c.fake.Fail(1, "InternalError", 500, 2*c.config.RequestTimeout)
+		fresh, err := c.fresh()
+		if err != nil {
+			return err
+		}
+		if err := expectFile(fresh, "/r", []byte("retried")); err != nil {
+			return err
+		}
+		stats := c.client.stats
+		if stats.Throttled < 2 || stats.Timeouts < 1 {
+			return fmt.Errorf("retries not counted: %v", stats)
+		}
+		return nil
+	})
+}
+
+
+func TestErrors(t *testing.T) {
+
+	runBackends(t, true, func(c *testCase) error {
+		c.fake.Fail(1, "AccessDenied", 403, 0)
+		_, err := c.h.Stat("/secret")
+		if err := expectErrno(err, fuse.EACCES, "stat when access is denied"); err != nil {
+			return err
+		}
+		c.fake.Fail(c.config.RetryMaxAttempts+defaultRetryMaxAttempts, "SlowDown", 503, 0)
+		_, err = c.h.Stat("/busy")
+		if err := expectErrno(err, fuse.EAGAIN, "stat when throttled past the retries"); err != nil {
+			return err
+		}
+		if c.client.stats.GaveUp == 0 {
+			return fmt.Errorf("giving up not counted: %v", c.client.stats)
+		}
+		return nil
+	})
+}
+
+
+func TestBodyRetry(t *testing.T) {
+
+	runBackends(t, true, func(c *testCase) error {
+		data := pattern(1 << 20)
+		err := c.h.WriteFile("/b", data)
+		if err != nil {
+			return err
+		}
+		// a body that breaks off, then one that stalls, is fetched again
+		// from where it stopped
+		c.fake.Cut(1, 0)
+		c.fake.Cut(1, 2*c.config.RequestTimeout)
+		fresh, err := c.fresh()
+		if err != nil {
+			return err
+		}
+		if err := expectFile(fresh, "/b", data); err != nil {
+			return err
+		}
+		if c.client.stats.Retries < 2 || c.client.stats.Timeouts < 1 {
+			return fmt.Errorf("body retries not counted: %v", c.client.stats)
+		}
+
+		// total_timeout ends a read that never gets anywhere
+		config := c.config
+		config.Endpoint = c.fake.URL()
+		config.TotalTimeout = time.Second
+		client, err := NewClient(config.Bucket, config)
+		if err != nil {
+			return err
+		}
+		h, err := NewHarness(client, config)
+		if err != nil {
+			return err
+		}
+		defer h.Destroy()
+		c.fake.Cut(1000, time.Minute)
+		start := time.Now()
+		_, err = h.ReadFile("/b")
+		if err := expectErrno(err, fuse.ETIMEDOUT, "read past total_timeout"); err != nil {
+			return err
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			return fmt.Errorf("read failed after %v", elapsed)
+		}
+		return nil
+	})
+}
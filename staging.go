@@ -0,0 +1,205 @@
+/*
+ * staging.go
+ * Disk-backed staging of written files
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+
+// default total size of all staging files, see staging_limit
+const defaultStagingLimit = 4 << 30
+
+
+// ErrStagingFull is returned when a write would take the staging files past
+// staging_limit.
+var ErrStagingFull = errors.New("staging: size limit reached")
+
+
+// StagingArea is the directory that staging files are created in, and the
+// budget they share.
+type StagingArea struct {
+
+	dir   string
+	limit int64   // 0 is unlimited
+	used  int64   // atomic
+}
+
+
+func NewStagingArea(dir string, limit int64) *StagingArea {
+
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return &StagingArea{dir: dir, limit: limit}
+}
+
+
+// reserve accounts for n more (or, negative, fewer) staged bytes.
+func (self *StagingArea) reserve(n int64) error {
+
+	used := atomic.AddInt64(&self.used, n)
+	if n > 0 && self.limit > 0 && used > self.limit {
+		atomic.AddInt64(&self.used, -n)
+		return ErrStagingFull
+	}
+	return nil
+}
+
+
+// Staging is a sparse temporary file holding the contents of one file being
+// written. Writes may land at any offset; gaps read back as zeros.
+type Staging struct {
+
+	area *StagingArea
+	f    *os.File
+
+	lock sync.Mutex
+	size int64
+}
+
+
+func NewStaging(area *StagingArea) (*Staging, error) {
+
+	f, err := os.CreateTemp(area.dir, "s3fs-staging-")
+	if err != nil {
+		return nil, err
+	}
+	return &Staging{area: area, f: f}, nil
+}
+
+
+func (self *Staging) WriteAt(p []byte, off int64) (int, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	end := off + int64(len(p))
+	if end > self.size {
+		err := self.area.reserve(end - self.size)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := self.f.WriteAt(p, off)
+	if off+int64(n) > self.size {
+		self.size = off + int64(n)
+	}
+	if end > self.size {
+		// give back what was not written
+		self.area.reserve(self.size - end)
+	}
+	return n, err
+}
+
+
+func (self *Staging) ReadAt(p []byte, off int64) (int, error) {
+
+	size := self.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		n, err := self.f.ReadAt(p, off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return self.f.ReadAt(p, off)
+}
+
+
+// Truncate sets the staged size, cutting or zero-extending the file.
+func (self *Staging) Truncate(size int64) error {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if size > self.size {
+		err := self.area.reserve(size - self.size)
+		if err != nil {
+			return err
+		}
+	} else {
+		self.area.reserve(size - self.size)
+	}
+
+	err := self.f.Truncate(size)
+	if err != nil {
+		return err
+	}
+	self.size = size
+	return nil
+}
+
+
+func (self *Staging) Size() int64 {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.size
+}
+
+
+// Fill copies the first size bytes of src into the staging file, for
+// changing part of an existing object.
+func (self *Staging) Fill(src io.ReaderAt, size int64) error {
+
+	buf := make([]byte, 8<<20)
+
+	for off := int64(0); off < size; {
+
+		if size-off < int64(len(buf)) {
+			buf = buf[:size-off]
+		}
+		n, err := src.ReadAt(buf, off)
+		if n > 0 {
+			_, werr := self.WriteAt(buf[:n], off)
+			if werr != nil {
+				return werr
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+
+// Close removes the staging file.
+func (self *Staging) Close() error {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.area.reserve(-self.size)
+	self.size = 0
+
+	self.f.Close()
+	return os.Remove(self.f.Name())
+}
+
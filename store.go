@@ -0,0 +1,126 @@
+/*
+ * store.go
+ * ObjectStore, the object storage operations the file system is built on
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+
+// ObjectStore is one bucket of an object store. S3 builds the file system
+// on these calls alone; AWSStore implements them on S3 and S3-compatible
+// servers, MemStore in memory.
+//
+// Keys are complete object keys, the prefix option is applied by S3.
+// Failures carry the S3 error code and HTTP status (see storeError), so that
+// fuseErrc reports the same errno whatever the store.
+type ObjectStore interface {
+
+	// List returns a page of the keys that start with prefix, in key order.
+	// With delimiter "/", keys that have another "/" after the prefix are
+	// rolled up into Prefixes. token is "" for the first page and
+	// ListPage.Next for the following ones; max <= 0 lets the store choose.
+	List(prefix string, delimiter string, token string, max int) (ListPage, error)
+
+	// Head returns the size, ETag, metadata and headers of key.
+	Head(key string) (ObjectInfo, error)
+
+	// GetRange reads n bytes of key from off, fewer at the end of the
+	// object, or all of it from off when n < 0. An offset at or past the end
+	// fails with io.EOF.
+	GetRange(key string, off int64, n int64) (io.ReadCloser, error)
+
+	// Put stores body as key.
+	Put(key string, body io.ReadSeeker, opts PutOptions) (ObjectInfo, error)
+
+	// Copy copies src to dst within the store, up to 5 GB. With opts nil dst
+	// keeps the metadata and headers of src.
+	Copy(src string, dst string, opts *PutOptions) (ObjectInfo, error)
+
+	Delete(key string) error
+
+	// DeleteKeys deletes up to 1000 keys at once.
+	DeleteKeys(keys []string) error
+
+	// Multipart uploads: parts are numbered from 1 and all but the last
+	// must be at least 5 MB.
+	CreateMultipart(key string, opts PutOptions) (string, error)
+	UploadPart(key string, uploadId string, n int64, body io.ReadSeeker) (string, error)
+	// UploadPartCopy makes part n of bytes [off, end) of object src.
+	UploadPartCopy(key string, uploadId string, n int64, src string, off int64, end int64) (string, error)
+	CompleteMultipart(key string, uploadId string, parts []Part) (ObjectInfo, error)
+	AbortMultipart(key string, uploadId string) error
+}
+
+
+// ObjectInfo describes an object. Listings leave Metadata and the headers
+// empty.
+type ObjectInfo struct {
+
+	Key          string
+	Size         int64
+	ETag         string // without quotes
+	LastModified time.Time
+	Metadata     map[string]*string // x-amz-meta-*, without the prefix
+	ContentHeaders
+}
+
+
+// ContentHeaders are the headers stored with an object and returned on GET;
+// empty ones are not set.
+type ContentHeaders struct {
+
+	ContentType        string
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+	ContentLanguage    string
+}
+
+
+type ListPage struct {
+
+	Objects  []ObjectInfo
+	Prefixes []string // with the delimiter at the end
+	Next     string   // token of the next page, "" after the last one
+}
+
+
+type PutOptions struct {
+
+	Metadata map[string]*string
+	ContentHeaders
+
+	// fail with PreconditionFailed if key exists; stores that cannot tell
+	// overwrite
+	IfNoneMatch bool
+}
+
+
+// Part is a completed part of a multipart upload.
+type Part struct {
+
+	Number int64
+	ETag   string
+}
+
+
+// storeError is a failure in the form AWSStore returns them, for stores
+// that are not S3.
+func storeError(code string, status int, message string) error {
+
+	return awserr.NewRequestFailure(awserr.New(code, message, nil), status, "")
+}
@@ -0,0 +1,213 @@
+/*
+ * truncate.go
+ * Truncation of stored objects without downloading them
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+
+// Truncate sets the size of the stored object fpath, existing bytes long:
+//
+//   - to zero with an empty PUT
+//   - shorter with a ranged server-side copy of the part that stays
+//   - longer with a multipart upload that copies the object server-side and
+//     appends zeros; objects smaller than a part are rewritten from here
+//
+// The object keeps its attributes, except mtime.
+func (self *S3) Truncate(fpath string, size int64, existing int64, meta ObjectMeta) error {
+
+	key := self.key(fpath)
+
+	switch {
+	case size == existing:
+		return nil
+
+	case size == 0:
+		meta.Mtime = nil
+		return self.Touch(fpath, meta)
+
+	case size > existing && existing < minPartSize:
+		w, err := self.NewWriter(fpath, existing, meta.uploadMeta())
+		if err != nil {
+			return err
+		}
+		err = w.Truncate(size)
+		if err != nil {
+			w.Abort()
+			return err
+		}
+		return w.Close()
+	}
+
+	head, err := self.store.Head(key)
+	if err != nil {
+		return err
+	}
+	metadata := meta.headers(head.Metadata)
+	delete(metadata, "mtime")
+
+	if size < existing {
+		_, _, err := self.multipartCopy(key, key, size, &head, metadata)
+		return err
+	}
+	return self.extend(key, existing, size, &head, metadata)
+}
+
+
+// extend rewrites key as its first existing bytes, copied server-side in
+// parts of at least the minimum part size, followed by zeros up to size.
+func (self *S3) extend(key string, existing int64, size int64, head *ObjectInfo, metadata map[string]*string) error {
+
+	uploadId, err := self.store.CreateMultipart(key, PutOptions{Metadata: metadata, ContentHeaders: head.ContentHeaders})
+	if err != nil {
+		return err
+	}
+
+	abort := func(err error) error {
+		self.store.AbortMultipart(key, uploadId)
+		return err
+	}
+
+	var parts []Part
+	n := int64(1)
+
+	// the copied parts are not last, so none may be short: a short tail is
+	// merged into the part before it
+	for off := int64(0); off < existing; n++ {
+		end := off + copyPartSize
+		if end > existing || existing-end < minPartSize {
+			end = existing
+		}
+
+		etag, err := self.store.UploadPartCopy(key, uploadId, n, key, off, end)
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, Part{Number: n, ETag: etag})
+		off = end
+	}
+
+	// zeros, in parts large enough to stay within 10000
+	zeros := size - existing
+	partSize := self.partSize
+	if left := 10000 - n + 1; zeros/partSize >= left {
+		partSize = zeros/left + 1
+	}
+	if partSize > zeros {
+		partSize = zeros
+	}
+	buf := make([]byte, partSize)
+
+	for ; zeros > 0; n++ {
+		chunk := buf
+		if zeros < int64(len(chunk)) {
+			chunk = chunk[:zeros]
+		}
+		etag, err := self.store.UploadPart(key, uploadId, n, bytes.NewReader(chunk))
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, Part{Number: n, ETag: etag})
+		zeros -= int64(len(chunk))
+	}
+
+	_, err = self.store.CompleteMultipart(key, uploadId, parts)
+	if err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+
+// Truncate follows truncate(2) and, with a handle, ftruncate(2). An open
+// writer is cut or extended in place and uploads on release; otherwise the
+// stored object is changed directly.
+func (self *S3fs) Truncate(path string, size int64, fh uint64) (errc int) {
+
+	if size < 0 {
+		return -fuse.EINVAL
+	}
+
+	node, errc := self.lookupMeta(path)
+	if errc != 0 {
+		return errc
+	}
+	if node.IsDir {
+		return -fuse.EISDIR
+	}
+
+	// without a handle, an open writer still has to see the change
+	file, found := self.getFile(fh)
+	if !found {
+		for _, f := range self.filesUnder(node.path()) {
+			f.lock.Lock()
+			found = f.node == node && f.writer != nil
+			f.lock.Unlock()
+			if found {
+				file = f
+				break
+			}
+		}
+	}
+
+	if found {
+		writer, errc := self.writer(file, size == 0)
+		if errc != 0 {
+			return errc
+		}
+		err := writer.Truncate(size)
+		if err != nil {
+			fmt.Println(path, err)
+			return fuseErrc(err)
+		}
+	} else {
+		if errc := self.settle(node); errc != 0 {
+			return errc
+		}
+
+		node.lock.Lock()
+		meta := node.Meta
+		node.lock.Unlock()
+
+		err := self.client.Truncate(node.path(), size, node.size(), meta)
+		if err != nil {
+			fmt.Println(path, err)
+			return fuseErrc(err)
+		}
+	}
+
+	node.lock.Lock()
+	node.Size = int(size)
+	node.Mtime = time.Now()
+	node.Meta.Mtime = nil
+	node.lock.Unlock()
+
+	// readers of other handles would see the old contents
+	for _, file := range self.filesUnder(node.path()) {
+		file.lock.Lock()
+		if ra, ok := file.ra.(*ReadAhead); ok {
+			ra.Close()
+		}
+		file.fp = nil
+		file.ra = nil
+		file.lock.Unlock()
+	}
+
+	self.cache.Changed(path)
+	return 0
+}
@@ -0,0 +1,252 @@
+/*
+ * upload.go
+ * Streaming multipart uploads of sequentially written files
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+
+// Defaults for the part_size and upload_concurrency mount options.
+const (
+	defaultPartSize          = 16 << 20
+	defaultUploadConcurrency = 4
+)
+
+
+// smallest part of a multipart upload, other than the last
+const minPartSize = 5 << 20
+
+// ErrNotSequential is returned by Upload.WriteAt for a write that does not
+// continue where the previous one ended.
+var ErrNotSequential = errors.New("upload: write is not sequential")
+
+// Upload streams a file into S3 while it is being written. Writes go through
+// a pipe to putObject, which cuts them into multipart upload parts and sends
+// up to upload_concurrency parts at once, so memory use stays at about
+// part_size * upload_concurrency whatever the file size. Files smaller than
+// one part end up as a single PutObject.
+//
+// Close completes the upload; Abort, or any failed part, aborts it so that no
+// parts are left behind.
+type Upload struct {
+
+	lock    sync.Mutex
+	pw      *io.PipeWriter
+	size    int64
+	closed  bool
+	aborted bool
+
+	done chan struct{}
+	err  error
+}
+
+
+// NewUpload starts streaming into key, with the given x-amz-meta-* metadata.
+func (self *S3) NewUpload(key string, meta map[string]*string) *Upload {
+
+	pr, pw := io.Pipe()
+	upload := &Upload{pw: pw, done: make(chan struct{})}
+
+	go func() {
+
+		err := self.putObject(key, pr, -1, PutOptions{Metadata: meta})
+
+		// unblock a writer stuck on a failed upload
+		upload.lock.Lock()
+		aborted := upload.aborted
+		upload.lock.Unlock()
+
+		if err != nil {
+			if !aborted {
+				fmt.Println(key, err)
+			}
+			pr.CloseWithError(err)
+		} else {
+			pr.Close()
+		}
+
+		upload.err = err
+		close(upload.done)
+	}()
+
+	return upload
+}
+
+
+// WriteAt appends p; off must equal the bytes written so far.
+func (self *Upload) WriteAt(p []byte, off int64) (int, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return 0, errors.New("upload: write after close")
+	}
+	if off != self.size {
+		return 0, ErrNotSequential
+	}
+
+	n, err := self.pw.Write(p)
+	self.size += int64(n)
+	return n, err
+}
+
+
+// Size returns the number of bytes written so far.
+func (self *Upload) Size() int64 {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.size
+}
+
+
+// Close ends the stream and waits for the upload to complete.
+func (self *Upload) Close() error {
+
+	self.lock.Lock()
+	if !self.closed {
+		self.closed = true
+		self.pw.Close()
+	}
+	self.lock.Unlock()
+
+	<-self.done
+	return self.err
+}
+
+
+// Abort fails the stream with err, which aborts the multipart upload, and
+// waits for the uploader to clean up.
+func (self *Upload) Abort(err error) {
+
+	self.lock.Lock()
+	if !self.closed {
+		self.closed = true
+		self.aborted = true
+		self.pw.CloseWithError(err)
+	}
+	self.lock.Unlock()
+
+	<-self.done
+}
+
+
+// putObject stores what body yields as key, size bytes or -1 when not known
+// in advance: one Put when it fits a part, otherwise a multipart upload of
+// part_size parts, upload_concurrency at a time, that is aborted if reading
+// body or any part fails. Parts grow to stay within 10000 when size is
+// known.
+func (self *S3) putObject(key string, body io.Reader, size int64, opts PutOptions) error {
+
+	partSize := self.partSize
+	if size/partSize >= 10000 {
+		partSize = size/9999 + 1
+	}
+
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(body, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = self.store.Put(key, bytes.NewReader(buf[:n]), opts)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadId, err := self.store.CreateMultipart(key, opts)
+	if err != nil {
+		return err
+	}
+
+	var lock sync.Mutex
+	var parts []Part
+	var failed error
+
+	fail := func(err error) {
+		lock.Lock()
+		if failed == nil {
+			failed = err
+		}
+		lock.Unlock()
+	}
+
+	sem := make(chan struct{}, self.concurrency)
+	var wg sync.WaitGroup
+
+	for num := int64(1); ; num++ {
+
+		sem <- struct{}{}
+		lock.Lock()
+		stop := failed != nil
+		lock.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+		if num > 10000 {
+			<-sem
+			fail(fmt.Errorf("%s: more than 10000 parts of %d bytes", key, partSize))
+			break
+		}
+
+		wg.Add(1)
+		go func(num int64, part []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			etag, err := self.store.UploadPart(key, uploadId, num, bytes.NewReader(part))
+			if err != nil {
+				fail(err)
+				return
+			}
+			lock.Lock()
+			parts = append(parts, Part{Number: num, ETag: etag})
+			lock.Unlock()
+		}(num, buf[:n])
+
+		if n < len(buf) {
+			break
+		}
+		buf = make([]byte, partSize)
+		n, err = io.ReadFull(body, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			fail(err)
+			break
+		}
+	}
+	wg.Wait()
+
+	if failed == nil {
+		sort.Slice(parts, func(i, j int) bool {
+			return parts[i].Number < parts[j].Number
+		})
+		_, failed = self.store.CompleteMultipart(key, uploadId, parts)
+		if failed == nil {
+			return nil
+		}
+	}
+
+	self.store.AbortMultipart(key, uploadId)
+	return failed
+}
@@ -0,0 +1,356 @@
+/*
+ * writer.go
+ * Write side of an open file: streaming with a staging fallback
+ * Copyright 2022 Daniel Vanderloo
+ */
+/*
+ * This file is part of Cgofuse.
+ *
+ * It is licensed under the MIT license. The full license text can be found
+ * in the License.txt file at the root of this project.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+
+// Writer is the write side of an open file. New and truncated files are
+// streamed with Upload while the writes stay sequential, and teed into a
+// staging file as long as that fits the staging budget. The first
+// out-of-order write aborts the stream and carries on in the staging file,
+// which is uploaded on Close. Writes into an existing object are staged from
+// the start, seeded with the current contents.
+//
+// Sync stores what has been written so far and keeps the Writer usable.
+type Writer struct {
+
+	client *S3
+	fpath  string
+	key    string
+	meta   map[string]*string
+
+	lock   sync.Mutex
+	upload *Upload
+	stage  *Staging
+	size   int64
+	dirty  bool     // staged changes not uploaded yet
+
+	// the file was removed while open, nothing is stored any more
+	unlinked bool
+}
+
+
+// NewWriter opens fpath for writing; existing is the size of the object
+// being changed, 0 for a new or truncated file. The stored object gets the
+// given x-amz-meta-* metadata.
+func (self *S3) NewWriter(fpath string, existing int64, meta map[string]*string) (*Writer, error) {
+
+	w := &Writer{client: self, fpath: fpath, key: self.key(fpath), meta: meta}
+
+	if existing > 0 {
+		w.size = existing
+		err := w.seed()
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
+	w.upload = self.NewUpload(w.key, meta)
+	stage, err := NewStaging(self.staging)
+	if err == nil {
+		w.stage = stage
+	}
+	return w, nil
+}
+
+
+// seed stages the stored object, for changing it in place.
+func (self *Writer) seed() error {
+
+	stage, err := NewStaging(self.client.staging)
+	if err != nil {
+		return err
+	}
+	err = stage.Fill(self.client.Open(self.fpath), self.size)
+	if err != nil {
+		stage.Close()
+		return err
+	}
+	self.stage = stage
+	return nil
+}
+
+
+func (self *Writer) WriteAt(p []byte, off int64) (int, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.writeAt(p, off)
+}
+
+
+// Append writes p at the end of the file, for O_APPEND.
+func (self *Writer) Append(p []byte) (int, error) {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.writeAt(p, self.size)
+}
+
+
+// writeAt is WriteAt with the lock held.
+func (self *Writer) writeAt(p []byte, off int64) (int, error) {
+
+	if self.upload != nil && off != self.size {
+		err := self.unstream()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// synced a stream without a tee, carry on from the stored object
+	if self.upload == nil && self.stage == nil {
+		err := self.restage()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if self.upload == nil {
+		n, err := self.stage.WriteAt(p, off)
+		if off+int64(n) > self.size {
+			self.size = off + int64(n)
+		}
+		self.dirty = true
+		return n, err
+	}
+
+	// streaming, keep the tee going while it fits
+	if self.stage != nil {
+		_, err := self.stage.WriteAt(p, off)
+		if err != nil {
+			self.stage.Close()
+			self.stage = nil
+		}
+	}
+
+	n, err := self.upload.WriteAt(p, off)
+	self.size += int64(n)
+	return n, err
+}
+
+
+// restage stages the stored object again, or nothing once it was unlinked.
+func (self *Writer) restage() error {
+
+	if !self.unlinked {
+		return self.seed()
+	}
+	stage, err := NewStaging(self.client.staging)
+	if err != nil {
+		return err
+	}
+	self.stage = stage
+	return nil
+}
+
+
+// unstream switches from streaming to the staging file.
+func (self *Writer) unstream() error {
+
+	if self.stage == nil {
+		return fmt.Errorf("%w past the staging limit", ErrNotSequential)
+	}
+
+	self.upload.Abort(ErrNotSequential)
+	self.upload = nil
+	self.dirty = true
+	return nil
+}
+
+
+// Truncate cuts or zero-extends the file to size. A stream can only be
+// restarted empty; any other size carries on in the staging file.
+func (self *Writer) Truncate(size int64) error {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if size == self.size && self.upload != nil {
+		return nil
+	}
+
+	if size == 0 && self.upload != nil {
+		self.upload.Abort(ErrNotSequential)
+		self.upload = self.client.NewUpload(self.key, self.meta)
+		if self.stage != nil {
+			self.stage.Truncate(0)
+		}
+		self.size = 0
+		return nil
+	}
+
+	if self.upload != nil {
+		err := self.unstream()
+		if err != nil {
+			return err
+		}
+	}
+	if self.stage == nil {
+		if size == 0 {
+			stage, err := NewStaging(self.client.staging)
+			if err != nil {
+				return err
+			}
+			self.stage = stage
+		} else {
+			err := self.restage()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := self.stage.Truncate(size)
+	if err != nil {
+		return err
+	}
+	self.size = size
+	self.dirty = true
+	return nil
+}
+
+
+// Move stores what has been written so far under the old name, for a
+// rename to copy, and continues under fpath.
+func (self *Writer) Move(fpath string) error {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	err := self.store()
+	if err != nil {
+		return err
+	}
+	self.fpath = fpath
+	self.key = self.client.key(fpath)
+	return nil
+}
+
+
+// ReadAt reads back what has been written, when it is still on disk.
+func (self *Writer) ReadAt(p []byte, off int64) (int, error) {
+
+	self.lock.Lock()
+	stage := self.stage
+	self.lock.Unlock()
+
+	if stage == nil {
+		return 0, ErrNotSequential
+	}
+	return stage.ReadAt(p, off)
+}
+
+
+func (self *Writer) Size() int64 {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.size
+}
+
+
+// store completes the stream or uploads the staging file. Called with the
+// lock held.
+func (self *Writer) store() error {
+
+	if self.unlinked {
+		self.dirty = false
+		return nil
+	}
+
+	if self.upload != nil {
+		err := self.upload.Close()
+		self.upload = nil
+		return err
+	}
+
+	if self.stage != nil && self.dirty {
+		size := self.stage.Size()
+		err := self.client.putObject(self.key, io.NewSectionReader(self.stage, 0, size), size, PutOptions{Metadata: self.meta})
+		if err != nil {
+			return err
+		}
+		self.dirty = false
+	}
+	return nil
+}
+
+
+// Sync blocks until everything written so far is stored in S3. Later writes
+// continue in the staging file.
+func (self *Writer) Sync() error {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.store()
+}
+
+
+// Close stores the file like Sync, and releases the staging file.
+func (self *Writer) Close() error {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	err := self.store()
+
+	if self.stage != nil {
+		self.stage.Close()
+		self.stage = nil
+	}
+	return err
+}
+
+
+// Unlink is for a file removed while open: the stream is aborted, and later
+// writes stay in the staging file, for reading back, and are never stored.
+func (self *Writer) Unlink() {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.unlinked = true
+	if self.upload != nil {
+		self.upload.Abort(errors.New("unlinked"))
+		self.upload = nil
+	}
+}
+
+
+// Abort drops everything written without storing it.
+func (self *Writer) Abort() {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.upload != nil {
+		self.upload.Abort(errors.New("aborted"))
+		self.upload = nil
+	}
+	if self.stage != nil {
+		self.stage.Close()
+		self.stage = nil
+	}
+}